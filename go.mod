@@ -3,13 +3,17 @@ module github.com/terra-farm/terraform-provider-virtualbox
 go 1.14
 
 require (
+	github.com/aws/aws-sdk-go v1.25.3
 	github.com/dustin/go-humanize v1.0.0
 	github.com/gopherjs/gopherjs v0.0.0-20200217142428-fce0ec30dd00 // indirect
 	github.com/hashicorp/go-multierror v1.1.0
 	github.com/hashicorp/hcl v1.0.0 // indirect
 	github.com/hashicorp/terraform-plugin-sdk v1.14.0
 	github.com/pkg/errors v0.9.1
+	github.com/pkg/sftp v1.11.0
 	github.com/smartystreets/assertions v1.1.1 // indirect
 	github.com/smartystreets/goconvey v1.6.4
 	github.com/terra-farm/go-virtualbox v0.0.4
+	golang.org/x/crypto v0.0.0-20190820162420-60c769a6c586
+	golang.org/x/sys v0.0.0-20200302150141-5c8b2ff67527
 )
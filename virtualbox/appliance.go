@@ -0,0 +1,214 @@
+package virtualbox
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+	"github.com/pkg/errors"
+	vbox "github.com/terra-farm/go-virtualbox"
+)
+
+const (
+	// Values of hardware_source.
+	hardwareTerraform = "terraform"
+	hardwareAppliance = "appliance"
+
+	// Storage controller for the optical disks of imported appliances, whose
+	// own controllers may have no free port.
+	applianceOpticalCtl = "Optical"
+)
+
+// isAppliance tells whether the image at path is an OVA or OVF appliance,
+// imported with 'VBoxManage import' rather than unpacked as gold image.
+func isAppliance(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ova", ".ovf":
+		return true
+	}
+	return false
+}
+
+// keepsApplianceHardware tells whether the VM keeps the hardware of the
+// appliance it is imported from. get reads the resource data or diff.
+func keepsApplianceHardware(get func(string) interface{}) bool {
+	if get("hardware_source").(string) != hardwareAppliance {
+		return false
+	}
+	image := get("image").(string)
+	if addr := get("url").(string); addr != "" {
+		image = addr
+	}
+	u, err := url.Parse(image)
+	if err != nil {
+		return false
+	}
+	return isAppliance(u.Path)
+}
+
+// suppressApplianceCPUs keeps the CPUs of VMs keeping the hardware of their
+// appliance, unless the configuration sets cpus to something else than the
+// default, which can't be told apart from leaving it out.
+func suppressApplianceCPUs(k, old, new string, d *schema.ResourceData) bool {
+	return keepsApplianceHardware(d.Get) && new == strconv.Itoa(defaultCPUs)
+}
+
+// suppressApplianceNICs keeps the network adapters of VMs keeping the
+// hardware of their appliance, unless the configuration has some. Without
+// any in the configuration, the data of the diff only holds the adapters of
+// the state, so they don't change.
+func suppressApplianceNICs(k, old, new string, d *schema.ResourceData) bool {
+	return keepsApplianceHardware(d.Get) && !d.HasChange("network_adapter")
+}
+
+// importArgs returns the 'VBoxManage import' arguments for the appliance at
+// path. The CPUs and memory of the appliance are overridden unless it keeps
+// its hardware and the configuration doesn't set them.
+func importArgs(d *schema.ResourceData, path, machineFolder string) ([]string, error) {
+	args := []string{"import", path, "--vsys", "0",
+		"--vmname", d.Get("name").(string),
+		"--basefolder", machineFolder,
+	}
+
+	keep := keepsApplianceHardware(d.Get)
+	// Unset when suppressed by suppressApplianceCPUs
+	if cpus := d.Get("cpus").(int); cpus > 0 {
+		args = append(args, "--cpus", strconv.Itoa(cpus))
+	}
+	_, hasMemory := d.GetOk("memory")
+	_, hasMemoryMB := d.GetOk("memory_mb")
+	if hasMemory || hasMemoryMB || !keep {
+		mib, err := memoryMiB(d)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "--memory", strconv.FormatUint(uint64(mib), 10))
+	}
+	return args, nil
+}
+
+// importAppliance imports the appliance at path as the VM. A failed import
+// leaves no VM behind.
+func importAppliance(d *schema.ResourceData, path, machineFolder string) (*vbox.Machine, error) {
+	name := d.Get("name").(string)
+	args, err := importArgs(d, path, machineFolder)
+	if err != nil {
+		return nil, err
+	}
+	// The VM found by name after a failed import is only ours to remove if
+	// there was none before
+	switch _, err := vbox.GetMachine(name); err {
+	case vbox.ErrMachineNotExist:
+	case nil:
+		return nil, fmt.Errorf("VM %s already exists", name)
+	default:
+		return nil, errors.Wrapf(err, "unable to look VM %s up", name)
+	}
+
+	var vm *vbox.Machine
+	_, err = vboxManage(args...)
+	if err == nil {
+		vm, err = vbox.GetMachine(name)
+	}
+	if err != nil {
+		// Imports failing midway may leave the VM registered, which would
+		// block the next apply with a name conflict
+		if vm, gerr := vbox.GetMachine(name); gerr == nil {
+			if rerr := removeVM(vm); rerr != nil {
+				log.Printf("[WARN] Unable to clean up VM %s: %v", name, rerr)
+			}
+		}
+		return nil, err
+	}
+	return vm, nil
+}
+
+// applianceModifyArgs returns the 'VBoxManage modifyvm' arguments applying
+// the hardware attributes set in the configuration of a VM keeping the
+// hardware of its appliance. Unlike tfToVbox, everything else, like the OS
+// type and firmware, is left as imported.
+func applianceModifyArgs(d *schema.ResourceData) ([]string, error) {
+	var args []string
+
+	if cpus := d.Get("cpus").(int); cpus > 0 && d.HasChange("cpus") {
+		args = append(args, "--cpus", strconv.Itoa(cpus))
+	}
+
+	_, hasMemory := d.GetOk("memory")
+	_, hasMemoryMB := d.GetOk("memory_mb")
+	if (hasMemory || hasMemoryMB) && d.HasChanges("memory", "memory_mb") {
+		mib, err := memoryMiB(d)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "--memory", strconv.FormatUint(uint64(mib), 10))
+	}
+
+	if bootOrder := d.Get("boot_order").([]interface{}); len(bootOrder) > 0 && d.HasChange("boot_order") {
+		for i, dev := range bootOrderTfToVbox(bootOrder) {
+			args = append(args, fmt.Sprintf("--boot%d", i+1), dev)
+		}
+	}
+
+	if d.HasChange("network_adapter") {
+		nics, err := netTfToVbox(d)
+		if err != nil {
+			return nil, err
+		}
+		for i, nic := range nics {
+			n := i + 1
+			args = append(args,
+				fmt.Sprintf("--nic%d", n), string(nic.Network),
+				fmt.Sprintf("--nictype%d", n), string(nic.Hardware),
+				fmt.Sprintf("--cableconnected%d", n), "on")
+			switch nic.Network {
+			case vbox.NICNetHostonly:
+				args = append(args, fmt.Sprintf("--hostonlyadapter%d", n), nic.HostInterface)
+			case vbox.NICNetBridged:
+				args = append(args, fmt.Sprintf("--bridgeadapter%d", n), nic.HostInterface)
+			}
+		}
+		for n := len(nics) + 1; n <= maxNetworkAdapters; n++ {
+			args = append(args, fmt.Sprintf("--nic%d", n), "none")
+		}
+	}
+	return args, nil
+}
+
+// modifyApplianceVM applies the hardware set in the configuration to a VM
+// keeping the hardware of its appliance.
+func modifyApplianceVM(d *schema.ResourceData, vm *vbox.Machine) error {
+	args, err := applianceModifyArgs(d)
+	if err != nil {
+		return err
+	}
+	if err := applyUserData(d, vm); err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	if _, err := vboxManage(append([]string{"modifyvm", vm.UUID}, args...)...); err != nil {
+		return err
+	}
+	return errors.Wrap(vm.Refresh(), "can't refresh VM")
+}
+
+// setupAppliance configures and starts a VM imported from an appliance.
+func setupAppliance(d *schema.ResourceData, vm *vbox.Machine) error {
+	if n := len(d.Get("optical_disks").([]interface{})); n > 0 {
+		if err := vm.AddStorageCtl(applianceOpticalCtl, vbox.StorageController{
+			SysBus:      vbox.SysBusSATA,
+			Ports:       uint(n),
+			Chipset:     vbox.CtrlIntelAHCI,
+			HostIOCache: true,
+		}); err != nil {
+			return errLogf("Create VirtualBox storage controller: %v", err)
+		}
+	}
+	return configureVM(d, vm, nil, applianceOpticalCtl, 0)
+}
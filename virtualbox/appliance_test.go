@@ -0,0 +1,179 @@
+package virtualbox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/resource"
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/terraform"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestApplianceImport(t *testing.T) {
+	Convey("Detect appliances by their extension", t, func() {
+		So(isAppliance("ubuntu.ova"), ShouldBeTrue)
+		So(isAppliance("/boxes/Ubuntu.OVF"), ShouldBeTrue)
+		So(isAppliance("ubuntu.box"), ShouldBeFalse)
+	})
+
+	Convey("Keep the appliance's hardware only for appliances", t, func() {
+		for image, keep := range map[string]bool{
+			"ubuntu.ova":                            true,
+			"https://example.com/ubuntu.ova?v=2":    true,
+			"https://example.com/ubuntu.box?x=.ova": false,
+		} {
+			d := schema.TestResourceDataRaw(t, resourceVM().Schema, map[string]interface{}{
+				"name": "node-01", "image": image, "hardware_source": "appliance",
+			})
+			So(keepsApplianceHardware(d.Get), ShouldEqual, keep)
+		}
+	})
+
+	Convey("Override the hardware of the appliance", t, func() {
+		d := schema.TestResourceDataRaw(t, resourceVM().Schema, map[string]interface{}{
+			"name": "node-01", "image": "ubuntu.ova",
+		})
+		args, err := importArgs(d, "ubuntu.ova", "/machines")
+		So(err, ShouldBeNil)
+		So(strings.Join(args, " "), ShouldEqual,
+			"import ubuntu.ova --vsys 0 --vmname node-01 --basefolder /machines --cpus 2 --memory 512")
+	})
+
+	Convey("Keep the hardware of the appliance unless set", t, func() {
+		d := schema.TestResourceDataRaw(t, resourceVM().Schema, map[string]interface{}{
+			"name": "node-01", "image": "ubuntu.ova", "hardware_source": "appliance",
+		})
+		args, err := importArgs(d, "ubuntu.ova", "/machines")
+		So(err, ShouldBeNil)
+		So(strings.Join(args, " "), ShouldEqual, "import ubuntu.ova --vsys 0 --vmname node-01 --basefolder /machines")
+
+		d = schema.TestResourceDataRaw(t, resourceVM().Schema, map[string]interface{}{
+			"name": "node-01", "image": "ubuntu.ova", "hardware_source": "appliance", "memory_mb": 2048,
+		})
+		args, err = importArgs(d, "ubuntu.ova", "/machines")
+		So(err, ShouldBeNil)
+		So(args, ShouldNotContain, "--cpus")
+		So(strings.Join(args, " "), ShouldEndWith, "--memory 2048")
+	})
+
+	Convey("Apply only the hardware set in the configuration", t, func() {
+		d := schema.TestResourceDataRaw(t, resourceVM().Schema, map[string]interface{}{
+			"name": "node-01", "image": "ubuntu.ova", "hardware_source": "appliance",
+			"cpus": 4, "boot_order": []interface{}{"dvd"},
+			"network_adapter": []interface{}{
+				map[string]interface{}{"type": "hostonly", "host_interface": "vboxnet0"},
+			},
+		})
+		args, err := applianceModifyArgs(d)
+		So(err, ShouldBeNil)
+		So(strings.Join(args, " "), ShouldEqual, "--cpus 4 "+
+			"--boot1 dvd --boot2 none --boot3 none --boot4 none "+
+			"--nic1 hostonly --nictype1 82545EM --cableconnected1 on --hostonlyadapter1 vboxnet0 "+
+			"--nic2 none --nic3 none --nic4 none")
+	})
+}
+
+func TestApplianceHardwarePlan(t *testing.T) {
+	// An imported appliance with one CPU and a NAT adapter
+	state := func(hardwareSource string) *terraform.InstanceState {
+		return &terraform.InstanceState{ID: testVMUUID, Attributes: map[string]string{
+			"name": "node-01", "image": "ubuntu.ova", "hardware_source": hardwareSource,
+			"status": "running", "cpus": "1", "network_adapter.#": "1",
+			"network_adapter.0.type": "nat", "network_adapter.0.device": "IntelPro1000MTDesktop",
+		}}
+	}
+	plan := func(hardwareSource string, raw map[string]interface{}) *terraform.InstanceDiff {
+		raw["name"], raw["image"], raw["hardware_source"] = "node-01", "ubuntu.ova", hardwareSource
+		diff, err := resourceVM().Diff(state(hardwareSource), terraform.NewResourceConfigRaw(raw), nil)
+		So(err, ShouldBeNil)
+		if diff == nil {
+			return &terraform.InstanceDiff{}
+		}
+		return diff
+	}
+
+	Convey("Keep the CPUs and adapters of the appliance when asked to", t, func() {
+		So(plan(hardwareAppliance, map[string]interface{}{}).Attributes, ShouldBeEmpty)
+
+		diff := plan(hardwareAppliance, map[string]interface{}{"cpus": 4})
+		So(diff.Attributes["cpus"].New, ShouldEqual, "4")
+	})
+
+	Convey("Apply the CPUs and adapters of the configuration otherwise", t, func() {
+		diff := plan(hardwareTerraform, map[string]interface{}{})
+		So(diff.Attributes["cpus"].New, ShouldEqual, "2")
+		So(diff.Attributes["network_adapter.#"].New, ShouldEqual, "0")
+	})
+}
+
+func TestFindSeedSlot(t *testing.T) {
+	seed := "/home/me/.terraform/virtualbox/machine/node-01/cidata.iso"
+
+	Convey("Find the slot of the attached seed", t, func() {
+		slot, attached, err := findSeedSlot(showVMInfoStorage, seed)
+		So(err, ShouldBeNil)
+		So(attached, ShouldBeTrue)
+		So(slot, ShouldResemble, seedSlot{Controller: "IDE Controller", Port: 0, Device: 0})
+	})
+
+	Convey("Share the IDE controller of the appliance", t, func() {
+		slot, attached, err := findSeedSlot(showVMInfoStorage, "/elsewhere/cidata.iso")
+		So(err, ShouldBeNil)
+		So(attached, ShouldBeFalse)
+		So(slot, ShouldResemble, seedSlot{Controller: "IDE Controller", Port: 0, Device: 1})
+	})
+
+	Convey("Add an IDE controller when there is none", t, func() {
+		info := strings.Split(showVMInfoStorage, "storagecontrollername1")[0]
+		slot, attached, err := findSeedSlot(info, seed)
+		So(err, ShouldBeNil)
+		So(attached, ShouldBeFalse)
+		So(slot, ShouldResemble, seedSlot{Controller: cloudInitStorageCtl, NewController: true})
+	})
+}
+
+func TestResourceVM_appliance(t *testing.T) {
+	fake := newFakeVBoxManage(t)
+	_, baseFolder := setupTestImage(t)
+	image := filepath.Join(os.Getenv("HOME"), "ubuntu.ova")
+	if err := ioutil.WriteFile(image, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	info := append(natVMInfo, "cpus=1", "memory=1024")
+	fake.script(t, append([]fakeCommand{
+		{Args: []string{"import"}, Create: []string{filepath.Join(baseFolder, "node-01.vbox")}, SetState: "poweroff"},
+	}, fakeVMLifecycle(baseFolder, info, natVMGuestInfo)...)...)
+
+	resource.UnitTest(t, resource.TestCase{
+		Providers:    testProviders(),
+		CheckDestroy: testCheckFakeDeleted(t, fake),
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`
+resource "virtualbox_vm" "node" {
+  name            = "node-01"
+  image           = %q
+  hardware_source = "appliance"
+}
+`, image),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("virtualbox_vm.node", "id", testVMUUID),
+					resource.TestCheckResourceAttr("virtualbox_vm.node", "cpus", "1"),
+					resource.TestCheckResourceAttr("virtualbox_vm.node", "memory_mb", "1024"),
+					resource.TestCheckResourceAttr("virtualbox_vm.node", "network_adapter.0.type", "nat"),
+					testCheckFakeCalled(t, fake,
+						"import "+image+" --vsys 0 --vmname node-01 --basefolder "+filepath.Dir(baseFolder),
+						"startvm node-01 --type headless"),
+					testCheckFakeNotCalled(t, fake, "--cpus"),
+					testCheckFakeNotCalled(t, fake, "createvm"),
+					testCheckFakeNotCalled(t, fake, "modifyvm"),
+				),
+			},
+		},
+	})
+}
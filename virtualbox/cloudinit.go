@@ -0,0 +1,190 @@
+package virtualbox
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+	"github.com/pkg/errors"
+	vbox "github.com/terra-farm/go-virtualbox"
+)
+
+const (
+	// Volume label cloud-init looks for to detect a NoCloud seed.
+	cloudInitVolumeID = "cidata"
+	// File name of the seed ISO inside the VM folder.
+	cloudInitSeedFile = "cidata.iso"
+	// Storage controller added for the seed ISO, so that it never competes
+	// with the disks of the gold image for SATA ports.
+	cloudInitStorageCtl = "IDE"
+)
+
+// cloudInitSeed returns the NoCloud seed files for the VM, or nil if neither
+// user data nor network configuration is set.
+func cloudInitSeed(d *schema.ResourceData, vm *vbox.Machine) ([]isoFile, error) {
+	userData, err := userDataPayload(d, vm)
+	if err != nil {
+		return nil, err
+	}
+	networkConfig := d.Get("network_config").(string)
+	if len(userData) == 0 && networkConfig == "" {
+		return nil, nil
+	}
+
+	metaData := d.Get("meta_data").(string)
+	if metaData == "" {
+		name := d.Get("name").(string)
+		metaData = fmt.Sprintf("instance-id: %s\nlocal-hostname: %s\n", name, name)
+	}
+
+	files := []isoFile{
+		{Name: "user-data", Data: userData},
+		{Name: "meta-data", Data: []byte(metaData)},
+	}
+	if networkConfig != "" {
+		files = append(files, isoFile{Name: "network-config", Data: []byte(networkConfig)})
+	}
+	return files, nil
+}
+
+// writeCloudInitSeed writes a NoCloud seed ISO with the given files to path.
+func writeCloudInitSeed(path string, files []isoFile) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.Wrap(err, "can't create seed ISO")
+	}
+	defer f.Close()
+
+	img := &isoImage{VolumeID: cloudInitVolumeID, Files: files, ModTime: time.Now()}
+	if _, err := img.WriteTo(f); err != nil {
+		return errors.Wrapf(err, "can't write seed ISO %s", path)
+	}
+	return f.Close()
+}
+
+// seedSlot is the drive slot of the seed ISO.
+type seedSlot struct {
+	Controller string
+	Port       int
+	Device     int
+	// The controller must be added first
+	NewController bool
+}
+
+// findSeedSlot returns the slot the seed ISO at path is attached to in the
+// machine readable 'showvminfo' output, or else the first free slot of the
+// IDE controller. The provider adds the IDE controller for the seed, but
+// imported appliances may come with one of their own, and VirtualBox allows
+// a single one per VM.
+func findSeedSlot(info, path string) (slot seedSlot, attached bool, err error) {
+	controllers, props, err := parseStorage(info)
+	if err != nil {
+		return seedSlot{}, false, err
+	}
+	for _, c := range controllers {
+		for port := 0; port < c.Ports; port++ {
+			for device := 0; device < 2; device++ {
+				if props[fmt.Sprintf("%s-%d-%d", c.Name, port, device)] == path {
+					return seedSlot{Controller: c.Name, Port: port, Device: device}, true, nil
+				}
+			}
+		}
+	}
+	for _, c := range controllers {
+		if !c.isIDE() {
+			continue
+		}
+		for port := 0; port < c.Ports; port++ {
+			for device := 0; device < 2; device++ {
+				medium, ok := props[fmt.Sprintf("%s-%d-%d", c.Name, port, device)]
+				if !ok || medium == "none" || medium == "emptydrive" {
+					return seedSlot{Controller: c.Name, Port: port, Device: device}, false, nil
+				}
+			}
+		}
+		return seedSlot{}, false, fmt.Errorf("no free slot on IDE controller %q", c.Name)
+	}
+	return seedSlot{Controller: cloudInitStorageCtl, NewController: true}, false, nil
+}
+
+// attachCloudInitSeed generates the NoCloud seed ISO from the resource data
+// and attaches it to the VM, replacing any seed attached before. The VM must
+// not be running.
+func attachCloudInitSeed(d *schema.ResourceData, vm *vbox.Machine) error {
+	path := filepath.Join(vm.BaseFolder, cloudInitSeedFile)
+	files, err := cloudInitSeed(d, vm)
+	if err != nil {
+		return err
+	}
+
+	hasSeed := true
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		hasSeed = false
+	}
+	if !hasSeed && files == nil {
+		return nil
+	}
+
+	info, err := vboxManage("showvminfo", vm.UUID, "--machinereadable")
+	if err != nil {
+		return errors.Wrap(err, "can't get storage controllers")
+	}
+	slot, attached, err := findSeedSlot(info, path)
+	if err != nil {
+		return errors.Wrap(err, "can't find a drive slot for seed ISO")
+	}
+
+	if hasSeed {
+		if err := detachCloudInitSeed(vm, slot, attached, path); err != nil {
+			return err
+		}
+	}
+	if files == nil {
+		return nil
+	}
+
+	log.Printf("[DEBUG] Writing cloud-init seed %s", path)
+	if err := writeCloudInitSeed(path, files); err != nil {
+		return err
+	}
+	if slot.NewController {
+		if err := vm.AddStorageCtl(slot.Controller, vbox.StorageController{
+			SysBus:  vbox.SysBusIDE,
+			Chipset: vbox.CtrlPIIX4,
+		}); err != nil {
+			return errors.Wrap(err, "can't create storage controller for seed ISO")
+		}
+	}
+	return errors.Wrap(vm.AttachStorage(slot.Controller, vbox.StorageMedium{
+		Port:      uint(slot.Port),
+		Device:    uint(slot.Device),
+		DriveType: vbox.DriveDVD,
+		Medium:    path,
+	}), "can't attach seed ISO")
+}
+
+// detachCloudInitSeed ejects the seed ISO and drops it from the media
+// registry, so that a regenerated image at the same path is picked up.
+func detachCloudInitSeed(vm *vbox.Machine, slot seedSlot, attached bool, path string) error {
+	if attached {
+		if err := vm.AttachStorage(slot.Controller, vbox.StorageMedium{
+			Port:      uint(slot.Port),
+			Device:    uint(slot.Device),
+			DriveType: vbox.DriveDVD,
+			Medium:    "emptydrive",
+		}); err != nil {
+			return errors.Wrap(err, "can't eject seed ISO")
+		}
+	}
+	// A seed left behind unattached may not be registered either
+	if _, err := vboxManage("closemedium", "dvd", path); err != nil {
+		if attached {
+			return errors.Wrap(err, "can't close seed ISO medium")
+		}
+		log.Printf("[DEBUG] Unable to close seed ISO medium %s: %v", path, err)
+	}
+	return errors.Wrap(os.Remove(path), "can't remove seed ISO")
+}
@@ -0,0 +1,306 @@
+package virtualbox
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Disk formats VirtualBox can't attach as they are, converted to VDI when
+// unpacking gold images.
+const (
+	diskFormatRaw   = "raw"
+	diskFormatVHD   = "vhd"
+	diskFormatQcow2 = "qcow2"
+)
+
+// convertedDiskExts maps the extensions of the converted disks to their
+// format, before sniffing: QEMU names qcow2 images .img as well.
+var convertedDiskExts = map[string]string{
+	".img":   diskFormatRaw,
+	".raw":   diskFormatRaw,
+	".vhd":   diskFormatVHD,
+	".qcow2": diskFormatQcow2,
+}
+
+var (
+	qcow2Magic = []byte("QFI\xfb")
+	vhdCookie  = []byte("conectix")
+)
+
+// sniffDiskFormat returns the format of the disk at path from its magic
+// numbers, falling back on its extension.
+func sniffDiskFormat(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	head := make([]byte, len(qcow2Magic))
+	if _, err := io.ReadFull(f, head); err == nil && bytes.Equal(head, qcow2Magic) {
+		return diskFormatQcow2, nil
+	}
+	// VHD disks end with a 512 bytes footer
+	if info, err := f.Stat(); err == nil && info.Size() >= 512 {
+		footer := make([]byte, len(vhdCookie))
+		if _, err := f.ReadAt(footer, info.Size()-512); err == nil && bytes.Equal(footer, vhdCookie) {
+			return diskFormatVHD, nil
+		}
+	}
+	if format := convertedDiskExts[strings.ToLower(filepath.Ext(path))]; format != diskFormatQcow2 {
+		return format, nil
+	}
+	return "", fmt.Errorf("%s is not a qcow2 image", path)
+}
+
+// convertDisk converts the disk at src to the VDI disk dst.
+func convertDisk(src, dst string) error {
+	format, err := sniffDiskFormat(src)
+	if err != nil {
+		return err
+	}
+	log.Printf("[DEBUG] Converting %s disk %s to %s", format, src, dst)
+
+	switch format {
+	case diskFormatVHD:
+		_, err = vboxManage("clonemedium", "disk", src, dst, "--format", "VDI")
+		// Both were registered by the clone, but the gold folder moves
+		for _, path := range []string{src, dst} {
+			if _, cerr := vboxManage("closemedium", "disk", path); cerr != nil {
+				log.Printf("[DEBUG] Unable to close medium %s: %v", path, cerr)
+			}
+		}
+		return err
+	case diskFormatQcow2:
+		raw := dst + ".raw"
+		defer os.Remove(raw)
+		if err := qcow2ToRaw(src, raw); err != nil {
+			return err
+		}
+		src = raw
+	}
+	_, err = vboxManage("convertfromraw", src, dst, "--format", "VDI")
+	return err
+}
+
+// convertDisks converts the disks under dir that VirtualBox can't attach to
+// VDI disks next to them, and removes the originals.
+func convertDisks(dir string) error {
+	var disks []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if _, ok := convertedDiskExts[strings.ToLower(filepath.Ext(path))]; ok && info.Mode().IsRegular() {
+			disks = append(disks, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, disk := range disks {
+		if err := convertDisk(disk, strings.TrimSuffix(disk, filepath.Ext(disk))+".vdi"); err != nil {
+			return errors.Wrapf(err, "can't convert %s", disk)
+		}
+		if err := os.Remove(disk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unpackDisk puts the bare disk image of the format into the gold folder
+// dir, converted to VDI if need be.
+func unpackDisk(image, format, dir string) error {
+	name := strings.TrimSuffix(filepath.Base(image), filepath.Ext(image))
+	if format != imageFormatVDI && format != imageFormatVMDK {
+		return convertDisk(image, filepath.Join(dir, name+".vdi"))
+	}
+
+	return copyFile(image, filepath.Join(dir, name+"."+format))
+}
+
+// copyFile copies the file at src to dst, removed again if the copy fails.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// qcow2Header is the part of the qcow2 header the reader needs, see
+// https://github.com/qemu/qemu/blob/master/docs/interop/qcow2.txt
+type qcow2Header struct {
+	Magic                 [4]byte
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+	// Version 3 only
+	IncompatibleFeatures uint64
+	CompatibleFeatures   uint64
+	AutoclearFeatures    uint64
+	RefcountOrder        uint32
+	HeaderLength         uint32
+}
+
+const (
+	qcow2OffsetMask  = 0x00fffffffffffe00
+	qcow2Compressed  = 1 << 62
+	qcow2ZeroCluster = 1
+	qcow2DirtyBit    = 1
+)
+
+// qcow2ToRaw writes the qcow2 image src as the sparse raw image dst. Images
+// with a backing file, encryption, an external data file or a compression
+// other than deflate are rejected.
+func qcow2ToRaw(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var h qcow2Header
+	if err := binary.Read(in, binary.BigEndian, &h); err != nil {
+		return errors.Wrap(err, "can't read qcow2 header")
+	}
+	switch {
+	case !bytes.Equal(h.Magic[:], qcow2Magic):
+		return fmt.Errorf("%s is not a qcow2 image", src)
+	case h.Version != 2 && h.Version != 3:
+		return fmt.Errorf("unsupported qcow2 version %d", h.Version)
+	case h.BackingFileOffset != 0:
+		return fmt.Errorf("qcow2 images with a backing file are not supported, flatten it with 'qemu-img convert'")
+	case h.CryptMethod != 0:
+		return fmt.Errorf("encrypted qcow2 images are not supported")
+	case h.ClusterBits < 9 || h.ClusterBits > 21:
+		return fmt.Errorf("invalid qcow2 cluster size 2^%d", h.ClusterBits)
+	}
+	if h.Version == 3 {
+		if h.IncompatibleFeatures&qcow2DirtyBit != 0 {
+			return fmt.Errorf("the qcow2 image was not closed cleanly, check it with 'qemu-img check -r all'")
+		}
+		// Like an external data file or another compression than deflate
+		if h.IncompatibleFeatures != 0 {
+			return fmt.Errorf("unsupported qcow2 features %#x, convert the image with 'qemu-img convert'",
+				h.IncompatibleFeatures)
+		}
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err := copyQcow2Clusters(in, out, &h); err != nil {
+		out.Close()
+		return err
+	}
+	// Unallocated clusters at the end are holes as well
+	if err := out.Truncate(int64(h.Size)); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// copyQcow2Clusters writes the allocated clusters of the qcow2 image in at
+// their guest offset in out, leaving holes for the others.
+func copyQcow2Clusters(in io.ReaderAt, out io.WriterAt, h *qcow2Header) error {
+	clusterSize := uint64(1) << h.ClusterBits
+	l2Entries := clusterSize / 8
+
+	l1 := make([]uint64, h.L1Size)
+	if err := binary.Read(io.NewSectionReader(in, int64(h.L1TableOffset), int64(h.L1Size)*8),
+		binary.BigEndian, l1); err != nil {
+		return errors.Wrap(err, "can't read qcow2 L1 table")
+	}
+
+	l2 := make([]uint64, l2Entries)
+	cluster := make([]byte, clusterSize)
+	for i, l1Entry := range l1 {
+		l2Offset := l1Entry & qcow2OffsetMask
+		if l2Offset == 0 {
+			continue
+		}
+		if err := binary.Read(io.NewSectionReader(in, int64(l2Offset), int64(clusterSize)),
+			binary.BigEndian, l2); err != nil {
+			return errors.Wrap(err, "can't read qcow2 L2 table")
+		}
+		for j, l2Entry := range l2 {
+			guestOffset := (uint64(i)*l2Entries + uint64(j)) * clusterSize
+			if guestOffset >= h.Size {
+				return nil
+			}
+			n := clusterSize
+			if h.Size-guestOffset < n {
+				n = h.Size - guestOffset
+			}
+
+			if l2Entry&qcow2Compressed != 0 {
+				if err := readCompressedCluster(in, l2Entry, h.ClusterBits, cluster); err != nil {
+					return err
+				}
+			} else {
+				hostOffset := l2Entry & qcow2OffsetMask
+				if hostOffset == 0 || l2Entry&qcow2ZeroCluster != 0 {
+					continue
+				}
+				if _, err := in.ReadAt(cluster[:n], int64(hostOffset)); err != nil {
+					return errors.Wrap(err, "can't read qcow2 cluster")
+				}
+			}
+			if _, err := out.WriteAt(cluster[:n], int64(guestOffset)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readCompressedCluster inflates the compressed cluster of the L2 entry
+// into cluster.
+func readCompressedCluster(in io.ReaderAt, l2Entry uint64, clusterBits uint32, cluster []byte) error {
+	offsetBits := 62 - (clusterBits - 8)
+	hostOffset := l2Entry & (1<<offsetBits - 1)
+	sectors := (l2Entry>>offsetBits)&(1<<(clusterBits-8)-1) + 1
+	size := sectors*512 - hostOffset%512
+
+	r := flate.NewReader(io.NewSectionReader(in, int64(hostOffset), int64(size)))
+	defer r.Close()
+	if _, err := io.ReadFull(r, cluster); err != nil {
+		return errors.Wrap(err, "can't inflate qcow2 cluster")
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package virtualbox
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// writeTestQcow2 writes a qcow2 image of 4 clusters of 512 bytes: the first
+// one plain, the third one compressed and the others unallocated. It
+// returns the raw content of the image.
+func writeTestQcow2(t *testing.T, path string, backingFile bool) []byte {
+	const clusterSize = 512
+	plain := bytes.Repeat([]byte("plain"), clusterSize/5+1)[:clusterSize]
+	packed := bytes.Repeat([]byte("packed"), clusterSize/6+1)[:clusterSize]
+
+	var compressed bytes.Buffer
+	w, err := flate.NewWriter(&compressed, flate.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(packed)
+	w.Close()
+
+	// Header, L1 table, L2 table, plain cluster and compressed cluster
+	image := make([]byte, 4*clusterSize+compressed.Len())
+	h := qcow2Header{
+		Version:       2,
+		ClusterBits:   9,
+		Size:          4 * clusterSize,
+		L1Size:        1,
+		L1TableOffset: clusterSize,
+	}
+	copy(h.Magic[:], qcow2Magic)
+	if backingFile {
+		h.BackingFileOffset, h.BackingFileSize = 200, 4
+	}
+	var header bytes.Buffer
+	binary.Write(&header, binary.BigEndian, &h)
+	copy(image, header.Bytes())
+	binary.BigEndian.PutUint64(image[clusterSize:], 1<<63|2*clusterSize)
+	binary.BigEndian.PutUint64(image[2*clusterSize:], 1<<63|3*clusterSize)
+	binary.BigEndian.PutUint64(image[2*clusterSize+16:], qcow2Compressed|4*clusterSize)
+	copy(image[3*clusterSize:], plain)
+	copy(image[4*clusterSize:], compressed.Bytes())
+	if err := ioutil.WriteFile(path, image, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := make([]byte, 4*clusterSize)
+	copy(raw, plain)
+	copy(raw[2*clusterSize:], packed)
+	return raw
+}
+
+func TestConvertDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tfvbox-convert-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	Convey("Read qcow2 images", t, func() {
+		image := filepath.Join(dir, "disk.qcow2")
+		raw := writeTestQcow2(t, image, false)
+		out := filepath.Join(dir, "disk.raw")
+		So(qcow2ToRaw(image, out), ShouldBeNil)
+		data, err := ioutil.ReadFile(out)
+		So(err, ShouldBeNil)
+		So(bytes.Equal(data, raw), ShouldBeTrue)
+	})
+
+	Convey("Reject qcow2 images with a backing file", t, func() {
+		image := filepath.Join(dir, "overlay.qcow2")
+		writeTestQcow2(t, image, true)
+		err := qcow2ToRaw(image, filepath.Join(dir, "overlay.raw"))
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "backing file")
+	})
+
+	Convey("Sniff the format of the disks", t, func() {
+		image := filepath.Join(dir, "cloud.img")
+		writeTestQcow2(t, image, false)
+		format, err := sniffDiskFormat(image)
+		So(err, ShouldBeNil)
+		So(format, ShouldEqual, diskFormatQcow2)
+
+		vhd := filepath.Join(dir, "disk.img")
+		So(ioutil.WriteFile(vhd, append(make([]byte, 1024), append(vhdCookie, make([]byte, 504)...)...), 0644), ShouldBeNil)
+		format, err = sniffDiskFormat(vhd)
+		So(err, ShouldBeNil)
+		So(format, ShouldEqual, diskFormatVHD)
+
+		raw := filepath.Join(dir, "disk.raw")
+		So(ioutil.WriteFile(raw, make([]byte, 1024), 0644), ShouldBeNil)
+		format, err = sniffDiskFormat(raw)
+		So(err, ShouldBeNil)
+		So(format, ShouldEqual, diskFormatRaw)
+
+		fake := filepath.Join(dir, "fake.qcow2")
+		So(ioutil.WriteFile(fake, make([]byte, 1024), 0644), ShouldBeNil)
+		_, err = sniffDiskFormat(fake)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestUnpackImage_disk(t *testing.T) {
+	Convey("Convert a bare disk image once into the gold folder", t, func() {
+		fake := newFakeVBoxManage(t)
+		fake.script(t, fakeCommand{Args: []string{"convertfromraw"}, CreateArgs: []int{2}})
+		dir, err := ioutil.TempDir("", "tfvbox-test-")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		image := filepath.Join(dir, "cloud.img")
+		writeTestQcow2(t, image, false)
+		gold := filepath.Join(dir, "cloud")
+
+		So(unpackImage(image, gold), ShouldBeNil)
+		So(unpackImage(image, gold), ShouldBeNil)
+
+		var converted []string
+		for _, call := range fake.calls(t) {
+			if strings.HasPrefix(call, "convertfromraw") {
+				converted = append(converted, call)
+			}
+		}
+		So(converted, ShouldHaveLength, 1)
+		So(converted[0], ShouldEndWith, "cloud.vdi --format VDI")
+		files, err := ioutil.ReadDir(gold)
+		So(err, ShouldBeNil)
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		So(names, ShouldContain, "cloud.vdi")
+		So(names, ShouldNotContain, "cloud.vdi.raw")
+	})
+
+	Convey("Convert the raw disks of an archive", t, func() {
+		fake := newFakeVBoxManage(t)
+		fake.script(t, fakeCommand{Args: []string{"convertfromraw"}, CreateArgs: []int{2}})
+		dir, err := ioutil.TempDir("", "tfvbox-test-")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		So(ioutil.WriteFile(filepath.Join(dir, "disk.raw"), make([]byte, 1024), 0644), ShouldBeNil)
+
+		So(convertDisks(dir), ShouldBeNil)
+		So(fake.calls(t), ShouldResemble, []string{
+			"convertfromraw " + filepath.Join(dir, "disk.raw") + " " + filepath.Join(dir, "disk.vdi") + " --format VDI",
+		})
+		_, err = os.Stat(filepath.Join(dir, "disk.vdi"))
+		So(err, ShouldBeNil)
+		_, err = os.Stat(filepath.Join(dir, "disk.raw"))
+		So(os.IsNotExist(err), ShouldBeTrue)
+	})
+}
@@ -0,0 +1,257 @@
+package virtualbox
+
+import (
+	"os"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+)
+
+func dataSourceHost() *schema.Resource {
+	return &schema.Resource{
+		Read: dataSourceHostRead,
+
+		Schema: map[string]*schema.Schema{
+
+			"version": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "VirtualBox version",
+			},
+
+			"cpus": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "Number of online logical processors",
+			},
+
+			"cpu_cores": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "Number of online processor cores",
+			},
+
+			"memory_total_mb": {
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+
+			"memory_available_mb": {
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+
+			"os_types": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "Guest OS types supported by VirtualBox",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+
+						"id": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+
+						"description": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+
+						"family_id": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+
+						"is_64_bit": {
+							Type:     schema.TypeBool,
+							Computed: true,
+						},
+					},
+				},
+			},
+
+			"host_only_interfaces": hostInterfacesSchema(),
+
+			"bridged_interfaces": hostInterfacesSchema(),
+
+			"dhcp_servers": {
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+
+						"network_name": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+
+						"ip_address": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+
+						"lower_ip_address": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+
+						"upper_ip_address": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+
+						"network_mask": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+
+						"enabled": {
+							Type:     schema.TypeBool,
+							Computed: true,
+						},
+					},
+				},
+			},
+
+			"extension_packs": {
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+
+						"name": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+
+						"version": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+
+						"revision": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+
+						"usable": {
+							Type:     schema.TypeBool,
+							Computed: true,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// hostInterfacesSchema is shared by the host-only and bridged interfaces.
+func hostInterfacesSchema() *schema.Schema {
+	return &schema.Schema{
+		Type:     schema.TypeList,
+		Computed: true,
+		Elem: &schema.Resource{
+			Schema: map[string]*schema.Schema{
+
+				"name": {
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+
+				"ipv4_address": {
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+
+				"network_mask": {
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+
+				"ipv6_address": {
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+
+				"mac_address": {
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+
+				"dhcp": {
+					Type:     schema.TypeBool,
+					Computed: true,
+				},
+
+				"wireless": {
+					Type:     schema.TypeBool,
+					Computed: true,
+				},
+
+				"status": {
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+			},
+		},
+	}
+}
+
+func dataSourceHostRead(d *schema.ResourceData, meta interface{}) error {
+	version, err := vboxManage("--version")
+	if err != nil {
+		return errLogf("unable to get VirtualBox version: %v", err)
+	}
+	if err = d.Set("version", strings.TrimSpace(version)); err != nil {
+		return errLogf("can't set version: %v", err)
+	}
+
+	info, err := getHostInfo()
+	if err != nil {
+		return errLogf("unable to get host info: %v", err)
+	}
+	for key, value := range map[string]interface{}{
+		"cpus":                info.CPUs,
+		"cpu_cores":           info.CPUCores,
+		"memory_total_mb":     int(info.MemoryTotalMB),
+		"memory_available_mb": int(info.MemoryAvailableMB),
+	} {
+		if err = d.Set(key, value); err != nil {
+			return errLogf("can't set %s: %v", key, err)
+		}
+	}
+
+	lists := []struct {
+		key   string
+		args  []string
+		parse func(string) ([]map[string]interface{}, error)
+	}{
+		{"os_types", []string{"list", "ostypes"}, parseOSTypes},
+		{"host_only_interfaces", []string{"list", "hostonlyifs"}, parseHostInterfaces},
+		{"bridged_interfaces", []string{"list", "bridgedifs"}, parseHostInterfaces},
+		{"dhcp_servers", []string{"list", "dhcpservers"}, parseDHCPServers},
+		{"extension_packs", []string{"list", "extpacks"}, parseExtPacks},
+	}
+	for _, l := range lists {
+		out, err := vboxManage(l.args...)
+		if err != nil {
+			return errLogf("unable to %s: %v", strings.Join(l.args, " "), err)
+		}
+		items, err := l.parse(out)
+		if err != nil {
+			return errLogf("can't parse %s: %v", strings.Join(l.args, " "), err)
+		}
+		if err = d.Set(l.key, items); err != nil {
+			return errLogf("can't set %s: %v", l.key, err)
+		}
+	}
+
+	// There is a single host, named after the machine Terraform runs on
+	hostname, err := os.Hostname()
+	if err != nil {
+		return errLogf("unable to get hostname: %v", err)
+	}
+	d.SetId(hostname)
+	return nil
+}
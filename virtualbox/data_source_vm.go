@@ -0,0 +1,316 @@
+package virtualbox
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+	vbox "github.com/terra-farm/go-virtualbox"
+)
+
+func dataSourceVM() *schema.Resource {
+	return &schema.Resource{
+		Read: dataSourceVMRead,
+
+		Schema: map[string]*schema.Schema{
+
+			"name": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Computed:     true,
+				ExactlyOneOf: []string{"name", "uuid"},
+			},
+
+			"uuid": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Computed: true,
+			},
+
+			"status": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			"cpus": {
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+
+			"memory": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			"memory_mb": {
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+
+			"network_adapter": {
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+
+						"type": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+
+						"device": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+
+						"host_interface": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+
+						"status": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+
+						"mac_address": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+
+						"ipv4_address": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+
+						"ipv4_address_available": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+					},
+				},
+			},
+
+			"disks": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "Media attached to the storage controllers of the VM",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+
+						"controller": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+
+						"port": {
+							Type:     schema.TypeInt,
+							Computed: true,
+						},
+
+						"device": {
+							Type:     schema.TypeInt,
+							Computed: true,
+						},
+
+						"type": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "Type of the drive, either hdd or dvd",
+						},
+
+						"path": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+					},
+				},
+			},
+
+			"extra_data": {
+				Type:     schema.TypeMap,
+				Computed: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+
+			"boot_order": {
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+		},
+	}
+}
+
+func dataSourceVMRead(d *schema.ResourceData, meta interface{}) error {
+	id := d.Get("uuid").(string)
+	if name := d.Get("name").(string); name != "" {
+		id = name
+	}
+
+	vm, err := vbox.GetMachine(id)
+	switch err {
+	case nil:
+		break
+	case vbox.ErrMachineNotExist:
+		return errLogf("no VM found matching %q", id)
+	default:
+		return errLogf("unable to get machine: %v", err)
+	}
+	d.SetId(vm.UUID)
+
+	if err = machineVboxToTf(vm, d); err != nil {
+		return err
+	}
+	if err = d.Set("uuid", vm.UUID); err != nil {
+		return errLogf("can't set uuid: %v", err)
+	}
+
+	if err = netVboxToTf(vm, d); err != nil {
+		return errLogf("can't convert vbox network to terraform data: %v", err)
+	}
+
+	out, err := vboxManage("showvminfo", vm.UUID, "--machinereadable")
+	if err != nil {
+		return errLogf("unable to get VM info: %v", err)
+	}
+	disks, err := parseStorageAttachments(out)
+	if err != nil {
+		return errLogf("can't parse storage attachments: %v", err)
+	}
+	if err = d.Set("disks", disks); err != nil {
+		return errLogf("can't set disks: %v", err)
+	}
+
+	out, err = vboxManage("getextradata", vm.UUID, "enumerate")
+	if err != nil {
+		return errLogf("unable to get extradata: %v", err)
+	}
+	extraData, err := parseExtraData(out)
+	if err != nil {
+		return errLogf("can't parse extradata: %v", err)
+	}
+	// The user data is sensitive for the virtualbox_vm resource
+	delete(extraData, "user_data")
+	if err = d.Set("extra_data", extraData); err != nil {
+		return errLogf("can't set extra_data: %v", err)
+	}
+
+	if err = d.Set("boot_order", vm.BootOrder); err != nil {
+		return errLogf("can't set boot_order: %v", err)
+	}
+
+	return nil
+}
+
+var reExtraDataLine = regexp.MustCompile(`^Key: (.*?), Value: (.*)$`)
+
+// storageController is a storage controller listed by 'showvminfo'.
+type storageController struct {
+	Name  string
+	Type  string
+	Ports int
+}
+
+// isIDE tells whether the controller is on the IDE bus, of which VirtualBox
+// allows a single one per VM.
+func (c storageController) isIDE() bool {
+	switch c.Type {
+	case "PIIX3", "PIIX4", "ICH6":
+		return true
+	}
+	return false
+}
+
+// parseMachineReadable parses the machine readable 'showvminfo' output into
+// its properties.
+func parseMachineReadable(out string) (map[string]string, error) {
+	props := make(map[string]string)
+	s := bufio.NewScanner(strings.NewReader(out))
+	for s.Scan() {
+		parts := strings.SplitN(s.Text(), "=", 2)
+		if len(parts) == 2 {
+			props[strings.Trim(parts[0], `"`)] = strings.Trim(parts[1], `"`)
+		}
+	}
+	return props, s.Err()
+}
+
+// parseStorage parses the storage controllers and the properties of the
+// machine readable 'showvminfo' output.
+func parseStorage(out string) ([]storageController, map[string]string, error) {
+	props, err := parseMachineReadable(out)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var controllers []storageController
+	for i := 0; ; i++ {
+		name, ok := props[fmt.Sprintf("storagecontrollername%d", i)]
+		if !ok {
+			break
+		}
+		ports, err := strconv.Atoi(props[fmt.Sprintf("storagecontrollerportcount%d", i)])
+		if err != nil {
+			ports = 30 // SATA maximum
+		}
+		controllers = append(controllers, storageController{
+			Name:  name,
+			Type:  props[fmt.Sprintf("storagecontrollertype%d", i)],
+			Ports: ports,
+		})
+	}
+	return controllers, props, nil
+}
+
+// parseStorageAttachments extracts the attached media from the machine
+// readable 'showvminfo' output, where each slot is listed as
+// "<controller>-<port>-<device>"="<medium>". Removable drives additionally
+// have a "<controller>-IsEjected-<port>-<device>" entry.
+func parseStorageAttachments(out string) ([]map[string]interface{}, error) {
+	controllers, props, err := parseStorage(out)
+	if err != nil {
+		return nil, err
+	}
+
+	disks := make([]map[string]interface{}, 0)
+	for _, c := range controllers {
+		ctl := c.Name
+		for port := 0; port < c.Ports; port++ {
+			for device := 0; device < 2; device++ {
+				slot := fmt.Sprintf("%d-%d", port, device)
+				medium, ok := props[ctl+"-"+slot]
+				if !ok || medium == "none" || medium == "emptydrive" {
+					continue
+				}
+				driveType := "hdd"
+				if _, removable := props[ctl+"-IsEjected-"+slot]; removable {
+					driveType = "dvd"
+				}
+				disks = append(disks, map[string]interface{}{
+					"controller": ctl,
+					"port":       port,
+					"device":     device,
+					"type":       driveType,
+					"path":       medium,
+				})
+			}
+		}
+	}
+	return disks, nil
+}
+
+// parseExtraData parses the output of 'getextradata <vm> enumerate'.
+func parseExtraData(out string) (map[string]interface{}, error) {
+	extraData := make(map[string]interface{})
+	s := bufio.NewScanner(strings.NewReader(out))
+	for s.Scan() {
+		if res := reExtraDataLine.FindStringSubmatch(s.Text()); res != nil {
+			extraData[res[1]] = res[2]
+		}
+	}
+	return extraData, s.Err()
+}
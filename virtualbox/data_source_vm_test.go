@@ -0,0 +1,66 @@
+package virtualbox
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// Excerpt of 'VBoxManage showvminfo --machinereadable' from VirtualBox 6.1
+const showVMInfoStorage = `name="node-01"
+storagecontrollername0="SATA"
+storagecontrollertype0="IntelAhci"
+storagecontrollerinstance0="0"
+storagecontrollermaxportcount0="30"
+storagecontrollerportcount0="3"
+storagecontrollerbootable0="on"
+storagecontrollername1="IDE Controller"
+storagecontrollertype1="PIIX4"
+storagecontrollerinstance1="0"
+storagecontrollermaxportcount1="2"
+storagecontrollerportcount1="2"
+storagecontrollerbootable1="on"
+"SATA-0-0"="/home/me/.terraform/virtualbox/machine/node-01/box-disk001.vmdk"
+"SATA-ImageUUID-0-0"="4c8b6d2e-6a5b-4d3e-9c1f-2a7d8e9f0a1b"
+"SATA-1-0"="none"
+"SATA-2-0"="/home/me/tools.iso"
+"SATA-ImageUUID-2-0"="5d9c7e3f-7b6c-4e4f-8d2a-3b8e9f0a1b2c"
+"SATA-IsEjected-2-0"="off"
+"IDE Controller-0-0"="/home/me/.terraform/virtualbox/machine/node-01/cidata.iso"
+"IDE Controller-ImageUUID-0-0"="6e0d8f4a-8c7d-4f5a-9e3b-4c9f0a1b2c3d"
+"IDE Controller-IsEjected-0-0"="off"
+"IDE Controller-0-1"="none"
+"IDE Controller-1-0"="none"
+"IDE Controller-1-1"="none"
+`
+
+// Excerpt of 'VBoxManage getextradata node-01 enumerate'
+const getExtraDataEnumerate = `Key: GUI/LastCloseAction, Value: PowerOff
+Key: user_data, Value: #cloud-config, with a comma
+`
+
+func TestParseStorageAttachments(t *testing.T) {
+	Convey("Parse the attached media from showvminfo", t, func() {
+		disks, err := parseStorageAttachments(showVMInfoStorage)
+		So(err, ShouldBeNil)
+		So(disks, ShouldResemble, []map[string]interface{}{
+			{"controller": "SATA", "port": 0, "device": 0, "type": "hdd",
+				"path": "/home/me/.terraform/virtualbox/machine/node-01/box-disk001.vmdk"},
+			{"controller": "SATA", "port": 2, "device": 0, "type": "dvd",
+				"path": "/home/me/tools.iso"},
+			{"controller": "IDE Controller", "port": 0, "device": 0, "type": "dvd",
+				"path": "/home/me/.terraform/virtualbox/machine/node-01/cidata.iso"},
+		})
+	})
+}
+
+func TestParseExtraData(t *testing.T) {
+	Convey("Parse the enumerated extradata", t, func() {
+		extraData, err := parseExtraData(getExtraDataEnumerate)
+		So(err, ShouldBeNil)
+		So(extraData, ShouldResemble, map[string]interface{}{
+			"GUI/LastCloseAction": "PowerOff",
+			"user_data":           "#cloud-config, with a comma",
+		})
+	})
+}
@@ -0,0 +1,200 @@
+package virtualbox
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// downloadConfig is the download block of the provider, applied to every
+// image fetch over HTTP. The TLS, proxy and timeout settings apply to S3
+// too.
+type downloadConfig struct {
+	BearerToken string
+	Username    string
+	Password    string
+	// Netrc looks the credentials up in NetrcFile, or the default .netrc
+	Netrc     bool
+	NetrcFile string
+	Headers   map[string]string
+
+	// CAFile holds PEM certificates trusted along with the system ones
+	CAFile             string
+	InsecureSkipVerify bool
+	Proxy              string
+	// Timeout bounds connecting and waiting for the response headers, not
+	// the download itself
+	Timeout time.Duration
+}
+
+// validateDuration checks that the value is a duration like "30s".
+func validateDuration(i interface{}, k string) ([]string, []error) {
+	s, ok := i.(string)
+	if !ok {
+		return nil, []error{fmt.Errorf("expected type of %s to be string", k)}
+	}
+	if d, err := time.ParseDuration(s); err != nil || d < 0 {
+		return nil, []error{fmt.Errorf("%s must be a positive duration like \"30s\", got %q", k, s)}
+	}
+	return nil, nil
+}
+
+// client returns the HTTP client of the image fetches.
+func (c downloadConfig) client() (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if c.Proxy != "" {
+		proxy, err := url.Parse(c.Proxy)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't parse download proxy")
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	if c.CAFile != "" || c.InsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+	}
+	if c.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't read download CA bundle")
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificate found in %s", c.CAFile)
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+
+	if c.Timeout > 0 {
+		transport.DialContext = (&net.Dialer{Timeout: c.Timeout, KeepAlive: 30 * time.Second}).DialContext
+		transport.TLSHandshakeTimeout = c.Timeout
+		transport.ResponseHeaderTimeout = c.Timeout
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// authorize sets the headers and credentials of the download settings on
+// the request. The credentials of the URL itself come before the netrc
+// file ones.
+func (c downloadConfig) authorize(req *http.Request) error {
+	for name, value := range c.Headers {
+		req.Header.Set(name, value)
+	}
+
+	switch {
+	case c.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+c.BearerToken)
+	case c.Username != "":
+		req.SetBasicAuth(c.Username, c.Password)
+	case req.URL.User != nil:
+		// Set by the HTTP client
+	case c.Netrc:
+		path := c.NetrcFile
+		if path == "" {
+			var err error
+			if path, err = defaultNetrcFile(); err != nil {
+				return err
+			}
+		}
+		login, password, err := netrcCredentials(path, req.URL.Hostname())
+		if err != nil {
+			return errors.Wrapf(err, "can't read %s", path)
+		}
+		if login != "" || password != "" {
+			req.SetBasicAuth(login, password)
+		}
+	}
+	return nil
+}
+
+// defaultNetrcFile returns $NETRC, or the .netrc file of the home
+// directory, _netrc on Windows.
+func defaultNetrcFile() (string, error) {
+	if path := os.Getenv("NETRC"); path != "" {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	if runtime.GOOS == "windows" {
+		return filepath.Join(home, "_netrc"), nil
+	}
+	return filepath.Join(home, ".netrc"), nil
+}
+
+// netrcCredentials returns the login and password of the host in the netrc
+// file at path, or of its default entry. A missing file has no credentials.
+func netrcCredentials(path, host string) (string, string, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	// Macros run until the next empty line
+	var tokens []string
+	inMacro := false
+	for _, line := range strings.Split(string(data), "\n") {
+		if inMacro {
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+		for _, field := range strings.Fields(line) {
+			if field == "macdef" {
+				inMacro = true
+				break
+			}
+			tokens = append(tokens, field)
+		}
+	}
+
+	var login, password string
+	matched, found := false, false
+	for i := 0; i < len(tokens); i++ {
+		switch tokens[i] {
+		case "machine", "default":
+			if found {
+				return login, password, nil
+			}
+			matched = tokens[i] == "default"
+			if !matched && i+1 < len(tokens) {
+				i++
+				matched = tokens[i] == host
+			}
+		case "login", "password", "account":
+			if i+1 >= len(tokens) {
+				break
+			}
+			i++
+			if !matched {
+				continue
+			}
+			found = true
+			switch tokens[i-1] {
+			case "login":
+				login = tokens[i]
+			case "password":
+				password = tokens[i]
+			}
+		}
+	}
+	return login, password, nil
+}
@@ -0,0 +1,137 @@
+package virtualbox
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// downloadProvider returns the provider config of the download settings.
+func downloadProvider(t *testing.T, c downloadConfig) *providerConfig {
+	client, err := c.client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &providerConfig{CacheDir: tempDir(t), Download: c, downloader: client}
+}
+
+func TestNetrcCredentials(t *testing.T) {
+	Convey("Look the credentials up in a netrc file", t, func() {
+		dir := tempDir(t)
+		path := filepath.Join(dir, ".netrc")
+		So(ioutil.WriteFile(path, []byte(`machine artifactory.example.com login ci password s3cret
+macdef init
+  machine artifactory.example.com login macro
+
+machine other.example.com
+  login other
+  password other
+default login anonymous password guest
+`), 0600), ShouldBeNil)
+
+		for host, want := range map[string][2]string{
+			"artifactory.example.com": {"ci", "s3cret"},
+			"other.example.com":       {"other", "other"},
+			"unknown.example.com":     {"anonymous", "guest"},
+		} {
+			login, password, err := netrcCredentials(path, host)
+			So(err, ShouldBeNil)
+			So([2]string{login, password}, ShouldResemble, want)
+		}
+
+		login, password, err := netrcCredentials(filepath.Join(dir, "missing"), "artifactory.example.com")
+		So(err, ShouldBeNil)
+		So(login+password, ShouldBeEmpty)
+	})
+}
+
+func TestFetchHTTPSettings(t *testing.T) {
+	var header http.Header
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		w.Write([]byte("box"))
+	}))
+	defer server.Close()
+
+	dir := tempDir(t)
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, ca, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("Trust the extra CAs", t, func() {
+		_, err := fetchURL(downloadProvider(t, downloadConfig{}), server.URL+"/ubuntu.box")
+		So(err, ShouldNotBeNil)
+
+		content, err := fetchURL(downloadProvider(t, downloadConfig{CAFile: caFile}), server.URL+"/ubuntu.box")
+		So(err, ShouldBeNil)
+		So(content, ShouldEqual, "box")
+
+		content, err = fetchURL(downloadProvider(t, downloadConfig{InsecureSkipVerify: true}), server.URL+"/ubuntu.box")
+		So(err, ShouldBeNil)
+		So(content, ShouldEqual, "box")
+	})
+
+	Convey("Send the credentials and headers", t, func() {
+		config := downloadProvider(t, downloadConfig{
+			CAFile: caFile, BearerToken: "t0ken", Headers: map[string]string{"X-JFrog-Art-Api": "key"},
+		})
+		_, err := fetchURL(config, server.URL+"/ubuntu.box")
+		So(err, ShouldBeNil)
+		So(header.Get("Authorization"), ShouldEqual, "Bearer t0ken")
+		So(header.Get("X-JFrog-Art-Api"), ShouldEqual, "key")
+
+		config = downloadProvider(t, downloadConfig{CAFile: caFile, Username: "ci", Password: "s3cret"})
+		_, err = fetchURL(config, server.URL+"/ubuntu.box")
+		So(err, ShouldBeNil)
+		So(header.Get("Authorization"), ShouldEqual, "Basic Y2k6czNjcmV0")
+
+		netrc := filepath.Join(dir, "netrc")
+		So(ioutil.WriteFile(netrc, []byte("machine 127.0.0.1 login ci password s3cret\n"), 0600), ShouldBeNil)
+		config = downloadProvider(t, downloadConfig{CAFile: caFile, Netrc: true, NetrcFile: netrc})
+		_, err = fetchURL(config, server.URL+"/ubuntu.box")
+		So(err, ShouldBeNil)
+		So(header.Get("Authorization"), ShouldEqual, "Basic Y2k6czNjcmV0")
+	})
+
+	Convey("Go through the proxy", t, func() {
+		var proxied string
+		proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			proxied = r.URL.String()
+			w.Write([]byte("box"))
+		}))
+		defer proxy.Close()
+
+		content, err := fetchURL(downloadProvider(t, downloadConfig{Proxy: proxy.URL}), "http://images.example.com/ubuntu.box")
+		So(err, ShouldBeNil)
+		So(content, ShouldEqual, "box")
+		So(proxied, ShouldEqual, "http://images.example.com/ubuntu.box")
+	})
+
+	Convey("Time out waiting for the response", t, func() {
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(500 * time.Millisecond)
+		}))
+		defer slow.Close()
+
+		_, err := fetchURL(downloadProvider(t, downloadConfig{Timeout: 50 * time.Millisecond}), slow.URL+"/ubuntu.box")
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "timeout")
+	})
+
+	Convey("Reject invalid settings", t, func() {
+		_, err := downloadConfig{CAFile: filepath.Join(dir, "missing.pem")}.client()
+		So(err, ShouldNotBeNil)
+		_, errs := validateDuration("5 minutes", "timeout")
+		So(errs, ShouldNotBeEmpty)
+		_, errs = validateDuration("5m", "timeout")
+		So(errs, ShouldBeEmpty)
+	})
+}
@@ -0,0 +1,196 @@
+package virtualbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The tests run against a fake VBoxManage: the test binary itself, linked
+// as VBoxManage in a directory put first on the PATH. The fake follows the
+// script written in $FAKE_VBOXMANAGE_DIR and records its invocations there,
+// along with a state string that scripted commands can match and change,
+// like the power state of a VM.
+const fakeVBoxManageDirEnv = "FAKE_VBOXMANAGE_DIR"
+
+// fakeCommand is a scripted answer of the fake VBoxManage.
+type fakeCommand struct {
+	// Args is the prefix of the arguments the command answers, "*" matches
+	// any argument.
+	Args     []string
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	// Create lists files the command creates, like the target of clonehd.
+	Create []string
+	// CreateArgs lists the indexes of the arguments naming files the
+	// command creates, like the target of convertfromraw.
+	CreateArgs []int
+	// State restricts the command to a state of the fake, SetState changes
+	// it once the command ran.
+	State    string
+	SetState string
+}
+
+func (c fakeCommand) matches(state string, args []string) bool {
+	if c.State != "" && c.State != state {
+		return false
+	}
+	if len(args) < len(c.Args) {
+		return false
+	}
+	for i, arg := range c.Args {
+		if arg != "*" && arg != args[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMain(m *testing.M) {
+	if filepath.Base(os.Args[0]) == "VBoxManage" {
+		os.Exit(runFakeVBoxManage(os.Args[1:]))
+	}
+
+	dir, err := ioutil.TempDir("", "fake-vboxmanage-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	exe, err := os.Executable()
+	if err == nil {
+		err = os.Symlink(exe, filepath.Join(dir, "VBoxManage"))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// runFakeVBoxManage answers a VBoxManage invocation with the first matching
+// command of the script; unscripted commands succeed silently.
+func runFakeVBoxManage(args []string) int {
+	dir := os.Getenv(fakeVBoxManageDirEnv)
+	if dir == "" {
+		fmt.Fprintln(os.Stderr, "fake VBoxManage: no script")
+		return 1
+	}
+
+	log, err := os.OpenFile(filepath.Join(dir, "calls"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer log.Close()
+	if _, err := fmt.Fprintln(log, strings.Join(args, " ")); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var script []fakeCommand
+	data, err := ioutil.ReadFile(filepath.Join(dir, "script.json"))
+	if err == nil {
+		err = json.Unmarshal(data, &script)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	state, err := ioutil.ReadFile(filepath.Join(dir, "state"))
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for _, c := range script {
+		if !c.matches(string(state), args) {
+			continue
+		}
+		create := c.Create
+		for _, i := range c.CreateArgs {
+			if i < len(args) {
+				create = append(create, args[i])
+			}
+		}
+		for _, path := range create {
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+		}
+		if c.SetState != "" {
+			if err := ioutil.WriteFile(filepath.Join(dir, "state"), []byte(c.SetState), 0644); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+		}
+		fmt.Fprint(os.Stdout, c.Stdout)
+		fmt.Fprint(os.Stderr, c.Stderr)
+		return c.ExitCode
+	}
+	return 0
+}
+
+// fakeVBoxManage scripts the fake VBoxManage of a test.
+type fakeVBoxManage struct {
+	dir string
+}
+
+// newFakeVBoxManage sets up an empty script, under which every command
+// succeeds without output.
+func newFakeVBoxManage(t *testing.T) *fakeVBoxManage {
+	dir, err := ioutil.TempDir("", "fake-vboxmanage-script-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(fakeVBoxManageDirEnv, dir)
+	t.Cleanup(func() {
+		os.Unsetenv(fakeVBoxManageDirEnv)
+		os.RemoveAll(dir)
+	})
+	return &fakeVBoxManage{dir: dir}
+}
+
+// script replaces the commands answered by the fake.
+func (f *fakeVBoxManage) script(t *testing.T, commands ...fakeCommand) {
+	data, err := json.Marshal(commands)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(f.dir, "script.json"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// calls returns the invocations of the fake, one line of arguments each.
+func (f *fakeVBoxManage) calls(t *testing.T) []string {
+	data, err := ioutil.ReadFile(filepath.Join(f.dir, "calls"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// state returns the current state of the fake.
+func (f *fakeVBoxManage) state(t *testing.T) string {
+	data, err := ioutil.ReadFile(filepath.Join(f.dir, "state"))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return string(data)
+}
@@ -0,0 +1,461 @@
+package virtualbox
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// fetcher fetches the images of a URL scheme. Local images are used in
+// place, at the path returned by local. Remote images are downloaded into
+// the cache folder by fetch.
+type fetcher struct {
+	local func(u *url.URL) (string, error)
+	// fetch downloads the remote image at u to w, with the credentials of
+	// the provider configuration, which may be nil. Given the cached
+	// download of the image, it returns errNotModified rather than
+	// downloading it again if the image didn't change. It returns the
+	// validators of the new download.
+	fetch func(config *providerConfig, u *url.URL, cached *download, w io.Writer) (*download, error)
+}
+
+// errNotModified tells that the remote image matches the cached download.
+var errNotModified = errors.New("image not modified")
+
+// fetchers are the fetchers of images, by URL scheme. Paths without scheme
+// are file:// images.
+var fetchers = map[string]fetcher{
+	"file":  {local: fetchFile},
+	"http":  {fetch: fetchHTTP},
+	"https": {fetch: fetchHTTP},
+	"s3":    {fetch: fetchS3},
+	"sftp":  {fetch: fetchSFTP},
+}
+
+// fetcherOf returns the fetcher of the image at u.
+func fetcherOf(u *url.URL) (fetcher, error) {
+	scheme := u.Scheme
+	if scheme == "" {
+		scheme = "file"
+	}
+	f, ok := fetchers[scheme]
+	if !ok {
+		schemes := make([]string, 0, len(fetchers))
+		for scheme := range fetchers {
+			schemes = append(schemes, scheme)
+		}
+		sort.Strings(schemes)
+		return fetcher{}, fmt.Errorf("unsupported scheme %s, use one of %s", u.Scheme, strings.Join(schemes, ", "))
+	}
+	return f, nil
+}
+
+// isRemote tells whether the image at u is downloaded into the cache folder.
+func isRemote(u *url.URL) bool {
+	f, err := fetcherOf(u)
+	return err == nil && f.fetch != nil
+}
+
+// fetchFile returns the path of local images, used in place.
+func fetchFile(u *url.URL) (string, error) {
+	if u.Host != "" && u.Host != "localhost" {
+		return "", fmt.Errorf("file URL %s is not on the local host", u)
+	}
+	return filepath.FromSlash(u.Path), nil
+}
+
+// download describes a complete download of the cache, in a JSON file next
+// to it.
+type download struct {
+	URL          string `json:"url"`
+	Size         int64  `json:"size"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// readDownload returns the download of the image at u cached at path, nil
+// if there is none or it is incomplete.
+func readDownload(path string, u *url.URL) *download {
+	data, err := ioutil.ReadFile(path + ".json")
+	if err != nil {
+		return nil
+	}
+	var cached download
+	if err := json.Unmarshal(data, &cached); err != nil {
+		log.Printf("[WARN] Ignoring the cached download %s: %v", path, err)
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Size() != cached.Size || cached.URL != displayURL(u) {
+		return nil
+	}
+	return &cached
+}
+
+// cachePath returns the path of the download of the remote image at u in
+// the cache folder. Images of different URLs may share their name, so each
+// URL gets a folder of its own.
+func cachePath(config *providerConfig, u *url.URL) (string, error) {
+	cacheFolder, err := config.cacheFolder()
+	if err != nil {
+		return "", err
+	}
+	key := sha256.Sum256([]byte(displayURL(u)))
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		name = "image"
+	}
+	return filepath.Join(cacheFolder, hex.EncodeToString(key[:8]), name), nil
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// fetchIfRemote returns the path of the image, downloaded first into the
+// cache folder if it is remote, and checked against its signature if it has
+// one.
+func fetchIfRemote(config *providerConfig, img *image) (string, error) {
+	path, err := fetchImage(config, img)
+	if err != nil || img.SignatureURL == "" {
+		return path, err
+	}
+	if err := img.verifySignature(config, path); err != nil {
+		return "", errors.Wrapf(err, "can't verify the signature of %s", img.URL)
+	}
+	return path, nil
+}
+
+// fetchImage returns the path of the image, downloaded first into the cache
+// folder if it is remote, and checked against its checksum if it has one. A
+// complete download is reused when its checksum matches or when the remote
+// image didn't change since.
+func fetchImage(config *providerConfig, img *image) (string, error) {
+	u, err := url.Parse(img.URL)
+	if err != nil {
+		return "", errors.Wrap(err, "can't parse image URL")
+	}
+	fetcher, err := fetcherOf(u)
+	if err != nil {
+		return "", err
+	}
+	if fetcher.local != nil {
+		path, err := fetcher.local(u)
+		if err != nil || img.Checksum == "" {
+			return path, err
+		}
+		if err := img.verify(path); err != nil {
+			return "", errors.Wrapf(err, "can't verify %s", path)
+		}
+		return path, nil
+	}
+
+	file, err := cachePath(config, u)
+	if err != nil {
+		return "", err
+	}
+	dir, name := filepath.Split(file)
+	if err := os.MkdirAll(dir, 0740); err != nil {
+		return "", err
+	}
+
+	lock, err := lockFile(file + ".lock")
+	if err != nil {
+		return "", err
+	}
+	defer lock.Unlock()
+
+	cached := readDownload(file, u)
+	if cached != nil && img.Checksum != "" {
+		if err := img.verify(file); err == nil {
+			log.Printf("[DEBUG] Reusing image %s downloaded to %s", displayURL(u), file)
+			return file, nil
+		}
+		cached = nil
+	}
+
+	f, err := ioutil.TempFile(dir, name+".part-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	log.Printf("[DEBUG] Fetching image %s to %s", displayURL(u), file)
+	w := &countingWriter{w: f}
+	fetched, err := fetcher.fetch(config, u, cached, w)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == errNotModified {
+		log.Printf("[DEBUG] Reusing image %s downloaded to %s, not modified", displayURL(u), file)
+		return file, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if img.Checksum != "" {
+		if err := img.verify(f.Name()); err != nil {
+			return "", errors.Wrapf(err, "can't verify %s", displayURL(u))
+		}
+	}
+
+	fetched.URL, fetched.Size = displayURL(u), w.n
+	data, err := json.Marshal(fetched)
+	if err != nil {
+		return "", err
+	}
+	// The download is complete once its description matches it: the old
+	// description goes first, so that no failure in between leaves it
+	// describing the new download
+	if err := os.Remove(file + ".json"); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if err := os.Rename(f.Name(), file); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(file+".json", data, 0640); err != nil {
+		return "", err
+	}
+	return file, nil
+}
+
+// displayURL returns u without its password, for logs and errors.
+func displayURL(u *url.URL) string {
+	shown := *u
+	if shown.User != nil {
+		shown.User = url.User(shown.User.Username())
+	}
+	return shown.String()
+}
+
+// fetchHTTP fetches http:// and https:// images, with the download
+// settings of the provider.
+func fetchHTTP(config *providerConfig, u *url.URL, cached *download, w io.Writer) (*download, error) {
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if config != nil {
+		if err := config.Download.authorize(req); err != nil {
+			return nil, err
+		}
+	}
+	if cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+	resp, err := config.downloadClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		return nil, errNotModified
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", displayURL(u), resp.Status)
+	}
+
+	n, err := io.Copy(w, resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ContentLength >= 0 && n != resp.ContentLength {
+		return nil, fmt.Errorf("GET %s: got %d bytes out of %d", displayURL(u), n, resp.ContentLength)
+	}
+	return &download{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}, nil
+}
+
+// fetchS3 fetches s3://bucket/key images, from AWS or the S3-compatible
+// endpoint of the provider configuration.
+func fetchS3(config *providerConfig, u *url.URL, cached *download, w io.Writer) (*download, error) {
+	var c s3Config
+	if config != nil {
+		c = config.S3
+	}
+	region := c.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	awsConfig := aws.NewConfig().WithRegion(region).WithHTTPClient(config.downloadClient())
+	// Services like MinIO don't serve buckets as subdomains
+	if c.Endpoint != "" {
+		awsConfig.WithEndpoint(c.Endpoint).WithS3ForcePathStyle(true)
+	}
+	// Otherwise the credentials come from the environment, the shared
+	// files or the instance role
+	if c.AccessKey != "" {
+		awsConfig.WithCredentials(credentials.NewStaticCredentials(c.AccessKey, c.SecretKey, c.SessionToken))
+	}
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't set up S3 session")
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(u.Host),
+		Key:    aws.String(strings.TrimPrefix(u.Path, "/")),
+	}
+	if cached != nil {
+		if cached.ETag != "" {
+			input.IfNoneMatch = aws.String(cached.ETag)
+		}
+		if t, err := http.ParseTime(cached.LastModified); err == nil {
+			input.IfModifiedSince = aws.Time(t)
+		}
+	}
+	out, err := s3.New(sess).GetObject(input)
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == http.StatusNotModified && cached != nil {
+		return nil, errNotModified
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't get %s", displayURL(u))
+	}
+	defer out.Body.Close()
+
+	n, err := io.Copy(w, out.Body)
+	if err != nil {
+		return nil, err
+	}
+	if out.ContentLength != nil && n != *out.ContentLength {
+		return nil, fmt.Errorf("can't get %s: got %d bytes out of %d", displayURL(u), n, *out.ContentLength)
+	}
+	fetched := &download{ETag: aws.StringValue(out.ETag)}
+	if out.LastModified != nil {
+		fetched.LastModified = out.LastModified.UTC().Format(http.TimeFormat)
+	}
+	return fetched, nil
+}
+
+// fetchSFTP fetches sftp://[user[:password]@]host[:port]/path images. The
+// cached download is reused while the size and modification time of the
+// remote file stay the same.
+func fetchSFTP(config *providerConfig, u *url.URL, cached *download, w io.Writer) (*download, error) {
+	var c sftpConfig
+	if config != nil {
+		c = config.SFTP
+	}
+	clientConfig, err := sftpClientConfig(c, u)
+	if err != nil {
+		return nil, err
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "22")
+	}
+	conn, err := ssh.Dial("tcp", host, clientConfig)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't connect to %s", host)
+	}
+	defer conn.Close()
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't start SFTP session on %s", host)
+	}
+	defer client.Close()
+
+	f, err := client.Open(u.Path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't open %s", u.Path)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't stat %s", u.Path)
+	}
+	fetched := &download{LastModified: info.ModTime().UTC().Format(http.TimeFormat)}
+	if cached != nil && cached.Size == info.Size() && cached.LastModified == fetched.LastModified {
+		return nil, errNotModified
+	}
+
+	if _, err := io.Copy(w, f); err != nil {
+		return nil, err
+	}
+	return fetched, nil
+}
+
+// sftpClientConfig returns the SSH configuration of the sftp:// URL u: the
+// user and password of the URL override those of the configuration.
+func sftpClientConfig(c sftpConfig, u *url.URL) (*ssh.ClientConfig, error) {
+	clientConfig := &ssh.ClientConfig{User: c.User}
+	password := c.Password
+	if u.User != nil {
+		clientConfig.User = u.User.Username()
+		if p, ok := u.User.Password(); ok {
+			password = p
+		}
+	}
+	if clientConfig.User == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, errors.Wrap(err, "no sftp user set")
+		}
+		clientConfig.User = current.Username
+	}
+
+	if c.PrivateKey != "" {
+		signer, err := ssh.ParsePrivateKey([]byte(c.PrivateKey))
+		if err != nil {
+			return nil, errors.Wrap(err, "can't parse sftp private key")
+		}
+		clientConfig.Auth = append(clientConfig.Auth, ssh.PublicKeys(signer))
+	}
+	if password != "" {
+		clientConfig.Auth = append(clientConfig.Auth, ssh.Password(password))
+	}
+
+	if c.InsecureIgnoreHostKey {
+		log.Printf("[WARN] Not checking the host key of %s", u.Host)
+		clientConfig.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+		return clientConfig, nil
+	}
+	knownHosts := c.KnownHostsFile
+	if knownHosts == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	callback, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read known hosts to check the sftp host key")
+	}
+	clientConfig.HostKeyCallback = callback
+	return clientConfig, nil
+}
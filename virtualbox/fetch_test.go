@@ -0,0 +1,336 @@
+package virtualbox
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// tempDir returns a temporary directory removed after the test.
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "tfvbox-fetch-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// fetchURL fetches the image at addr and returns its content.
+func fetchURL(config *providerConfig, addr string) (string, error) {
+	path, err := fetchIfRemote(config, &image{URL: addr})
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadFile(path)
+	return string(data), err
+}
+
+func TestFetchIfRemote(t *testing.T) {
+	Convey("Use local images in place", t, func() {
+		path, err := fetchIfRemote(nil, &image{URL: "file:///boxes/ubuntu.box"})
+		So(err, ShouldBeNil)
+		So(path, ShouldEqual, filepath.FromSlash("/boxes/ubuntu.box"))
+
+		_, err = fetchIfRemote(nil, &image{URL: "file://nas/boxes/ubuntu.box"})
+		So(err, ShouldNotBeNil)
+
+		path, err = fetchIfRemote(nil, &image{URL: "/boxes/ubuntu.box"})
+		So(err, ShouldBeNil)
+		So(path, ShouldEqual, filepath.FromSlash("/boxes/ubuntu.box"))
+
+		for addr, remote := range map[string]bool{
+			"/boxes/ubuntu.box": false, "file:///boxes/ubuntu.box": false,
+			"https://images.example.com/ubuntu.box": true, "gs://bucket/ubuntu.box": false,
+		} {
+			u, err := url.Parse(addr)
+			So(err, ShouldBeNil)
+			So(isRemote(u), ShouldEqual, remote)
+		}
+	})
+
+	Convey("Verify local images against their checksum", t, func() {
+		path := filepath.Join(tempDir(t), "ubuntu.box")
+		So(ioutil.WriteFile(path, []byte("box"), 0644), ShouldBeNil)
+		for _, addr := range []string{path, "file://" + filepath.ToSlash(path)} {
+			// sha256 of "box"
+			img := &image{URL: addr, ChecksumType: "sha256",
+				Checksum: "26f8567f2569182294c3fa5b9f9cb2270b554eef628b4c149cf82a42888ff4ae"}
+			_, err := fetchIfRemote(nil, img)
+			So(err, ShouldBeNil)
+
+			img.Checksum = "0000"
+			_, err = fetchIfRemote(nil, img)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "checksum does not match")
+		}
+	})
+
+	Convey("Reject unknown schemes", t, func() {
+		_, err := fetchIfRemote(nil, &image{URL: "gs://bucket/ubuntu.box"})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "file, http, https, s3, sftp")
+	})
+
+	Convey("Fail on HTTP errors", t, func() {
+		dir := tempDir(t)
+		server := httptest.NewServer(http.NotFoundHandler())
+		defer server.Close()
+
+		_, err := fetchURL(&providerConfig{CacheDir: dir}, server.URL+"/ubuntu.box")
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "404")
+		files, err := filepath.Glob(filepath.Join(dir, "*", "ubuntu.box*"))
+		So(err, ShouldBeNil)
+		So(files, ShouldResemble, []string{filepath.Join(filepath.Dir(files[0]), "ubuntu.box.lock")})
+	})
+}
+
+func TestFetchCache(t *testing.T) {
+	Convey("Revalidate cached downloads", t, func() {
+		content, etag := "box v1", `"v1"`
+		var downloads int
+		var ifNoneMatch string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ifNoneMatch = r.Header.Get("If-None-Match")
+			if ifNoneMatch == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			downloads++
+			w.Header().Set("ETag", etag)
+			w.Write([]byte(content))
+		}))
+		defer server.Close()
+		config := &providerConfig{CacheDir: tempDir(t)}
+
+		path, err := fetchIfRemote(config, &image{URL: server.URL + "/ubuntu.box"})
+		So(err, ShouldBeNil)
+		So(path, ShouldStartWith, config.CacheDir)
+		So(filepath.Base(path), ShouldEqual, "ubuntu.box")
+
+		got, err := fetchURL(config, server.URL+"/ubuntu.box")
+		So(err, ShouldBeNil)
+		So(got, ShouldEqual, "box v1")
+		So(ifNoneMatch, ShouldEqual, `"v1"`)
+		So(downloads, ShouldEqual, 1)
+
+		content, etag = "box v2", `"v2"`
+		got, err = fetchURL(config, server.URL+"/ubuntu.box")
+		So(err, ShouldBeNil)
+		So(got, ShouldEqual, "box v2")
+		So(downloads, ShouldEqual, 2)
+
+		// Another URL of the same name doesn't share the download
+		other, err := fetchIfRemote(config, &image{URL: server.URL + "/other/ubuntu.box"})
+		So(err, ShouldBeNil)
+		So(other, ShouldNotEqual, path)
+		So(downloads, ShouldEqual, 3)
+	})
+
+	Convey("Forget the description of a download being replaced", t, func() {
+		content := "box v1"
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", `"`+content+`"`)
+			w.Write([]byte(content))
+		}))
+		defer server.Close()
+		config := &providerConfig{CacheDir: tempDir(t)}
+
+		path, err := fetchIfRemote(config, &image{URL: server.URL + "/ubuntu.box"})
+		So(err, ShouldBeNil)
+		_, err = os.Stat(path + ".json")
+		So(err, ShouldBeNil)
+
+		// The new download can't replace the old one
+		So(os.Remove(path), ShouldBeNil)
+		So(os.MkdirAll(filepath.Join(path, "busy"), 0755), ShouldBeNil)
+		content = "box v2"
+		_, err = fetchIfRemote(config, &image{URL: server.URL + "/ubuntu.box"})
+		So(err, ShouldNotBeNil)
+		_, err = os.Stat(path + ".json")
+		So(os.IsNotExist(err), ShouldBeTrue)
+	})
+
+	Convey("Reuse downloads matching the checksum", t, func() {
+		var downloads int
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			downloads++
+			w.Write([]byte("box"))
+		}))
+		defer server.Close()
+		config := &providerConfig{CacheDir: tempDir(t)}
+		// sha256 of "box"
+		img := &image{URL: server.URL + "/ubuntu.box", ChecksumType: "sha256",
+			Checksum: "26f8567f2569182294c3fa5b9f9cb2270b554eef628b4c149cf82a42888ff4ae"}
+
+		_, err := fetchIfRemote(config, img)
+		So(err, ShouldBeNil)
+		_, err = fetchIfRemote(config, img)
+		So(err, ShouldBeNil)
+		So(downloads, ShouldEqual, 1)
+
+		img.Checksum = "0000"
+		_, err = fetchIfRemote(config, img)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "checksum does not match")
+		So(downloads, ShouldEqual, 2)
+	})
+}
+
+func TestFetchS3(t *testing.T) {
+	Convey("Fetch images from an S3-compatible endpoint", t, func() {
+		var auth string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/images/boxes/ubuntu.box" {
+				http.NotFound(w, r)
+				return
+			}
+			auth = r.Header.Get("Authorization")
+			if r.Header.Get("If-None-Match") == `"box"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"box"`)
+			w.Write([]byte("box"))
+		}))
+		defer server.Close()
+
+		config := &providerConfig{CacheDir: tempDir(t), S3: s3Config{
+			Endpoint: server.URL, Region: "us-east-1", AccessKey: "minio", SecretKey: "minio123",
+		}}
+		content, err := fetchURL(config, "s3://images/boxes/ubuntu.box")
+		So(err, ShouldBeNil)
+		So(content, ShouldEqual, "box")
+		So(auth, ShouldContainSubstring, "Credential=minio/")
+
+		content, err = fetchURL(config, "s3://images/boxes/ubuntu.box")
+		So(err, ShouldBeNil)
+		So(content, ShouldEqual, "box")
+	})
+}
+
+// startSFTPServer serves the local files over SFTP to the user "vagrant",
+// with the password "secret", and returns its address and host key.
+func startSFTPServer(t *testing.T) (string, ssh.PublicKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == "vagrant" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+	}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(conn, config)
+		}
+	}()
+	return l.Addr().String(), signer.PublicKey()
+}
+
+func serveSFTP(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				// The payload is the length-prefixed name of the subsystem
+				ok := req.Type == "subsystem" && strings.HasSuffix(string(req.Payload), "sftp")
+				req.Reply(ok, nil)
+				if ok {
+					if server, err := sftp.NewServer(channel); err == nil {
+						server.Serve()
+					}
+					channel.Close()
+				}
+			}
+		}()
+	}
+}
+
+func TestFetchSFTP(t *testing.T) {
+	addr, hostKey := startSFTPServer(t)
+	image, err := filepath.Abs(filepath.Join("testdata", "hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageURL := "sftp://vagrant@" + addr + filepath.ToSlash(image)
+
+	Convey("Fetch images over SFTP, checking the host key", t, func() {
+		dir := tempDir(t)
+		knownHosts := filepath.Join(dir, "known_hosts")
+		So(ioutil.WriteFile(knownHosts, []byte(knownhosts.Line([]string{addr}, hostKey)+"\n"), 0644), ShouldBeNil)
+
+		config := &providerConfig{CacheDir: dir, SFTP: sftpConfig{Password: "secret", KnownHostsFile: knownHosts}}
+		content, err := fetchURL(config, imageURL)
+		So(err, ShouldBeNil)
+		So(content, ShouldEqual, "Hello, world!")
+	})
+
+	Convey("Reject unknown hosts", t, func() {
+		dir := tempDir(t)
+		knownHosts := filepath.Join(dir, "known_hosts")
+		So(ioutil.WriteFile(knownHosts, nil, 0644), ShouldBeNil)
+
+		config := &providerConfig{CacheDir: dir, SFTP: sftpConfig{Password: "secret", KnownHostsFile: knownHosts}}
+		_, err := fetchURL(config, imageURL)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "key is unknown")
+	})
+
+	Convey("Take the password of the URL", t, func() {
+		config := &providerConfig{CacheDir: tempDir(t), SFTP: sftpConfig{Password: "wrong", InsecureIgnoreHostKey: true}}
+		_, err := fetchURL(config, imageURL)
+		So(err, ShouldNotBeNil)
+
+		content, err := fetchURL(config, strings.Replace(imageURL, "vagrant@", "vagrant:secret@", 1))
+		So(err, ShouldBeNil)
+		So(content, ShouldEqual, "Hello, world!")
+	})
+}
@@ -0,0 +1,233 @@
+package virtualbox
+
+import (
+	"bufio"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	vbox "github.com/terra-farm/go-virtualbox"
+)
+
+// hostInfo is the capacity of the host, as reported by 'list hostinfo'.
+type hostInfo struct {
+	CPUs              int
+	CPUCores          int
+	MemoryTotalMB     uint64
+	MemoryAvailableMB uint64
+	OS                string
+	OSVersion         string
+}
+
+// parseColonBlocks parses the "Key: value" listings of VBoxManage, where
+// blank lines separate the entries. Indented lines belong to nested sections
+// and are skipped.
+func parseColonBlocks(out string) ([]map[string]string, error) {
+	var blocks []map[string]string
+	var block map[string]string
+	s := bufio.NewScanner(strings.NewReader(out))
+	for s.Scan() {
+		line := s.Text()
+		if strings.TrimSpace(line) == "" {
+			block = nil
+			continue
+		}
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if block == nil {
+			block = make(map[string]string)
+			blocks = append(blocks, block)
+		}
+		block[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return blocks, s.Err()
+}
+
+// parseMByte parses sizes like "32041 MByte".
+func parseMByte(s string) (uint64, error) {
+	return strconv.ParseUint(strings.TrimSpace(strings.TrimSuffix(s, "MByte")), 10, 64)
+}
+
+// parseHostInfo parses the output of 'list hostinfo'.
+func parseHostInfo(out string) (*hostInfo, error) {
+	blocks, err := parseColonBlocks(out)
+	if err != nil {
+		return nil, err
+	}
+	props := make(map[string]string)
+	for _, block := range blocks {
+		for k, v := range block {
+			props[k] = v
+		}
+	}
+
+	info := &hostInfo{
+		OS:        props["Operating system"],
+		OSVersion: props["Operating system version"],
+	}
+	if info.CPUs, err = strconv.Atoi(props["Processor online count"]); err != nil {
+		return nil, errors.Wrap(err, "can't parse processor count")
+	}
+	if info.CPUCores, err = strconv.Atoi(props["Processor online core count"]); err != nil {
+		return nil, errors.Wrap(err, "can't parse processor core count")
+	}
+	if info.MemoryTotalMB, err = parseMByte(props["Memory size"]); err != nil {
+		return nil, errors.Wrap(err, "can't parse memory size")
+	}
+	if info.MemoryAvailableMB, err = parseMByte(props["Memory available"]); err != nil {
+		return nil, errors.Wrap(err, "can't parse available memory")
+	}
+	return info, nil
+}
+
+// getHostInfo returns the capacity of the host.
+func getHostInfo() (*hostInfo, error) {
+	out, err := vboxManage("list", "hostinfo")
+	if err != nil {
+		return nil, err
+	}
+	return parseHostInfo(out)
+}
+
+var reRunningVM = regexp.MustCompile(`^".*" \{([0-9a-fA-F-]+)\}$`)
+
+// parseRunningVMs parses the output of 'list runningvms' into VM UUIDs.
+func parseRunningVMs(out string) []string {
+	var uuids []string
+	s := bufio.NewScanner(strings.NewReader(out))
+	for s.Scan() {
+		if res := reRunningVM.FindStringSubmatch(strings.TrimSpace(s.Text())); res != nil {
+			uuids = append(uuids, res[1])
+		}
+	}
+	return uuids
+}
+
+// getRunningVMs returns the VMs running on the host.
+func getRunningVMs() ([]*vbox.Machine, error) {
+	out, err := vboxManage("list", "runningvms")
+	if err != nil {
+		return nil, err
+	}
+	var vms []*vbox.Machine
+	for _, uuid := range parseRunningVMs(out) {
+		vm, err := vbox.GetMachine(uuid)
+		switch err {
+		case nil:
+			vms = append(vms, vm)
+		case vbox.ErrMachineNotExist:
+			// Powered off and unregistered since the listing
+		default:
+			return nil, errors.Wrapf(err, "unable to get machine %s", uuid)
+		}
+	}
+	return vms, nil
+}
+
+// parseOSTypes parses the output of 'list ostypes'.
+func parseOSTypes(out string) ([]map[string]interface{}, error) {
+	blocks, err := parseColonBlocks(out)
+	if err != nil {
+		return nil, err
+	}
+	osTypes := make([]map[string]interface{}, 0, len(blocks))
+	for _, b := range blocks {
+		osTypes = append(osTypes, map[string]interface{}{
+			"id":          b["ID"],
+			"description": b["Description"],
+			"family_id":   b["Family ID"],
+			"is_64_bit":   b["64 bit"] == "true",
+		})
+	}
+	return osTypes, nil
+}
+
+// parseHostInterfaces parses the output of 'list hostonlyifs' and
+// 'list bridgedifs'.
+func parseHostInterfaces(out string) ([]map[string]interface{}, error) {
+	blocks, err := parseColonBlocks(out)
+	if err != nil {
+		return nil, err
+	}
+	ifs := make([]map[string]interface{}, 0, len(blocks))
+	for _, b := range blocks {
+		ifs = append(ifs, map[string]interface{}{
+			"name":         b["Name"],
+			"ipv4_address": b["IPAddress"],
+			"network_mask": b["NetworkMask"],
+			"ipv6_address": b["IPV6Address"],
+			"mac_address":  b["HardwareAddress"],
+			"dhcp":         b["DHCP"] == "Enabled",
+			"wireless":     b["Wireless"] == "Yes",
+			"status":       strings.ToLower(b["Status"]),
+		})
+	}
+	return ifs, nil
+}
+
+// parseDHCPServers parses the output of 'list dhcpservers'. VirtualBox 6.1
+// renamed the "IP" field to "Dhcpd IP" and capitalized the address ranges.
+func parseDHCPServers(out string) ([]map[string]interface{}, error) {
+	blocks, err := parseColonBlocks(out)
+	if err != nil {
+		return nil, err
+	}
+	servers := make([]map[string]interface{}, 0, len(blocks))
+	for _, b := range blocks {
+		field := func(names ...string) string {
+			for _, name := range names {
+				if v, ok := b[name]; ok {
+					return v
+				}
+			}
+			return ""
+		}
+		servers = append(servers, map[string]interface{}{
+			"network_name":     b["NetworkName"],
+			"ip_address":       field("Dhcpd IP", "IP"),
+			"lower_ip_address": field("LowerIPAddress", "lowerIPAddress"),
+			"upper_ip_address": field("UpperIPAddress", "upperIPAddress"),
+			"network_mask":     b["NetworkMask"],
+			"enabled":          b["Enabled"] == "Yes",
+		})
+	}
+	return servers, nil
+}
+
+// parseExtPacks parses the output of 'list extpacks', where each pack starts
+// with a "Pack no. N:" line.
+func parseExtPacks(out string) ([]map[string]interface{}, error) {
+	var packs []map[string]interface{}
+	var pack map[string]interface{}
+	s := bufio.NewScanner(strings.NewReader(out))
+	for s.Scan() {
+		parts := strings.SplitN(s.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if strings.HasPrefix(key, "Pack no.") {
+			pack = map[string]interface{}{"name": value, "version": "", "revision": "", "usable": false}
+			packs = append(packs, pack)
+			continue
+		}
+		if pack == nil {
+			continue
+		}
+		switch key {
+		case "Version":
+			pack["version"] = value
+		case "Revision":
+			pack["revision"] = value
+		case "Usable":
+			pack["usable"] = value == "true"
+		}
+	}
+	return packs, s.Err()
+}
@@ -0,0 +1,103 @@
+package virtualbox
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// readVBoxManageOutput returns VBoxManage output captured in testdata.
+func readVBoxManageOutput(name string) string {
+	out, err := ioutil.ReadFile(filepath.Join("testdata", "vboxmanage", name))
+	So(err, ShouldBeNil)
+	return string(out)
+}
+
+func TestParseHostInfo(t *testing.T) {
+	Convey("Parse list hostinfo", t, func() {
+		info, err := parseHostInfo(readVBoxManageOutput("list_hostinfo.txt"))
+		So(err, ShouldBeNil)
+		So(*info, ShouldResemble, hostInfo{
+			CPUs:              8,
+			CPUCores:          4,
+			MemoryTotalMB:     32041,
+			MemoryAvailableMB: 20156,
+			OS:                "Linux",
+			OSVersion:         "5.4.0-31-generic",
+		})
+	})
+
+	Convey("Reject truncated list hostinfo", t, func() {
+		_, err := parseHostInfo("Host Information:\n\nProcessor online count: 8\n")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestParseHostLists(t *testing.T) {
+	Convey("Parse list ostypes", t, func() {
+		osTypes, err := parseOSTypes(readVBoxManageOutput("list_ostypes.txt"))
+		So(err, ShouldBeNil)
+		So(osTypes, ShouldHaveLength, 3)
+		So(osTypes[1], ShouldResemble, map[string]interface{}{
+			"id": "Ubuntu_64", "description": "Ubuntu (64-bit)", "family_id": "Linux", "is_64_bit": true,
+		})
+	})
+
+	Convey("Parse list hostonlyifs", t, func() {
+		ifs, err := parseHostInterfaces(readVBoxManageOutput("list_hostonlyifs.txt"))
+		So(err, ShouldBeNil)
+		So(ifs, ShouldHaveLength, 2)
+		So(ifs[0], ShouldResemble, map[string]interface{}{
+			"name": "vboxnet0", "ipv4_address": "192.168.56.1", "network_mask": "255.255.255.0",
+			"ipv6_address": "fe80::800:27ff:fe00:0", "mac_address": "0a:00:27:00:00:00",
+			"dhcp": false, "wireless": false, "status": "up",
+		})
+		So(ifs[1]["dhcp"], ShouldBeTrue)
+		So(ifs[1]["ipv6_address"], ShouldEqual, "")
+	})
+
+	Convey("Parse list bridgedifs", t, func() {
+		ifs, err := parseHostInterfaces(readVBoxManageOutput("list_bridgedifs.txt"))
+		So(err, ShouldBeNil)
+		So(ifs, ShouldHaveLength, 2)
+		So(ifs[0]["name"], ShouldEqual, "enp3s0")
+		So(ifs[1]["wireless"], ShouldBeTrue)
+		So(ifs[1]["status"], ShouldEqual, "down")
+	})
+
+	Convey("Parse list dhcpservers", t, func() {
+		servers, err := parseDHCPServers(readVBoxManageOutput("list_dhcpservers.txt"))
+		So(err, ShouldBeNil)
+		So(servers, ShouldHaveLength, 2)
+		So(servers[0], ShouldResemble, map[string]interface{}{
+			"network_name": "HostInterfaceNetworking-vboxnet0", "ip_address": "192.168.56.100",
+			"lower_ip_address": "192.168.56.101", "upper_ip_address": "192.168.56.254",
+			"network_mask": "255.255.255.0", "enabled": true,
+		})
+		So(servers[1]["enabled"], ShouldBeFalse)
+	})
+
+	Convey("Parse list dhcpservers from VirtualBox 5", t, func() {
+		servers, err := parseDHCPServers("NetworkName:    HostInterfaceNetworking-vboxnet0\n" +
+			"IP:             192.168.56.100\n" +
+			"NetworkMask:    255.255.255.0\n" +
+			"lowerIPAddress: 192.168.56.101\n" +
+			"upperIPAddress: 192.168.56.254\n" +
+			"Enabled:        Yes\n")
+		So(err, ShouldBeNil)
+		So(servers, ShouldHaveLength, 1)
+		So(servers[0]["ip_address"], ShouldEqual, "192.168.56.100")
+		So(servers[0]["lower_ip_address"], ShouldEqual, "192.168.56.101")
+	})
+
+	Convey("Parse list extpacks", t, func() {
+		packs, err := parseExtPacks(readVBoxManageOutput("list_extpacks.txt"))
+		So(err, ShouldBeNil)
+		So(packs, ShouldResemble, []map[string]interface{}{{
+			"name": "Oracle VM VirtualBox Extension Pack", "version": "6.1.8",
+			"revision": "137981", "usable": true,
+		}})
+	})
+}
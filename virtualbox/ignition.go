@@ -0,0 +1,55 @@
+package virtualbox
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+	vbox "github.com/terra-farm/go-virtualbox"
+)
+
+// Guest property Ignition reads its config from on the VirtualBox platform.
+const ignitionConfigProperty = "/Ignition/Config"
+
+// validateIgnitionConfig checks that the value is a JSON object declaring
+// the Ignition spec version it is written for, small enough to be handed to
+// VBoxManage on its command line.
+func validateIgnitionConfig(i interface{}, k string) ([]string, []error) {
+	v, ok := i.(string)
+	if !ok {
+		return nil, []error{fmt.Errorf("expected type of %s to be string", k)}
+	}
+	if v == "" {
+		return nil, nil
+	}
+	if len(v) > maxExtraDataSize {
+		return nil, []error{fmt.Errorf(
+			"%s is %d bytes, the limit of a guest property set by VBoxManage is %d bytes",
+			k, len(v), maxExtraDataSize)}
+	}
+
+	var cfg struct {
+		Ignition *struct {
+			Version string `json:"version"`
+		} `json:"ignition"`
+	}
+	if err := json.Unmarshal([]byte(v), &cfg); err != nil {
+		return nil, []error{fmt.Errorf("%s is not a valid Ignition config: %v", k, err)}
+	}
+	if cfg.Ignition == nil || cfg.Ignition.Version == "" {
+		return nil, []error{fmt.Errorf("%s is missing the \"ignition.version\" field", k)}
+	}
+	return nil, nil
+}
+
+// setIgnitionConfig hands the Ignition config over to the guest, removing it
+// when the config is empty. Ignition only runs on first boot, so changing the
+// config of a provisioned VM has no effect until it is reprovisioned.
+func setIgnitionConfig(vm *vbox.Machine, config string) error {
+	if config == "" {
+		return errors.Wrap(vbox.DeleteGuestProperty(vm.UUID, ignitionConfigProperty),
+			"can't delete Ignition config")
+	}
+	return errors.Wrap(vbox.SetGuestProperty(vm.UUID, ignitionConfigProperty, config),
+		"can't set Ignition config")
+}
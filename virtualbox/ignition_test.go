@@ -0,0 +1,24 @@
+package virtualbox
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestValidateIgnitionConfig(t *testing.T) {
+	Convey("Validate Ignition configs at plan time", t, func() {
+		_, errs := validateIgnitionConfig(`{"ignition": {"version": "3.1.0"}}`, "ignition_config")
+		So(errs, ShouldBeEmpty)
+
+		_, errs = validateIgnitionConfig(`{"passwd": {}}`, "ignition_config")
+		So(errs, ShouldHaveLength, 1)
+
+		large := fmt.Sprintf(`{"ignition": {"version": "3.1.0"}, "padding": %q}`, strings.Repeat("x", maxExtraDataSize))
+		_, errs = validateIgnitionConfig(large, "ignition_config")
+		So(errs, ShouldHaveLength, 1)
+		So(errs[0].Error(), ShouldContainSubstring, "the limit")
+	})
+}
@@ -13,11 +13,12 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/pkg/errors"
 )
 
-//nolint:unused
 type image struct {
 	// Image URL where to download from
 	URL string
@@ -25,60 +26,175 @@ type image struct {
 	Checksum string
 	// Algorithm use to check the checksum
 	ChecksumType string
-	// Internal file reference
-	file *os.File
+	// URL of the detached OpenPGP or minisign signature of the image, or of
+	// a checksum file listing it
+	SignatureURL string
+	// Public key trusted to sign the image
+	PublicKey string
 }
 
+// Formats of the images, told by their extension unless a virtualbox_image
+// sets it. Bare disks are in one of the disk formats of convert.go too.
+const (
+	// Tar archive, compressed or not, like a Vagrant box
+	imageFormatBox  = "box"
+	imageFormatOVA  = "ova"
+	imageFormatOVF  = "ovf"
+	imageFormatVDI  = "vdi"
+	imageFormatVMDK = "vmdk"
+)
+
+// imageFormat returns the format of the image at path from its extension.
+func imageFormat(path string) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	switch ext {
+	case ".ova", ".ovf", ".vdi", ".vmdk":
+		return ext[1:]
+	}
+	if format, ok := convertedDiskExts[ext]; ok {
+		return format
+	}
+	return imageFormatBox
+}
+
+// goldCompleteMarker is written into a gold folder once the image is fully
+// unpacked, so an interrupted unpack is detected and retried.
+const goldCompleteMarker = ".complete"
+
+// lockGold holds the lock of the gold folder toDir, shared with the other
+// Terraform processes.
+func lockGold(toDir string) (*fileLock, error) {
+	return lockFile(toDir + ".lock")
+}
+
+// rlockGold holds a shared lock of the gold folder toDir, for the processes
+// reading it.
+func rlockGold(toDir string) (*fileLock, error) {
+	return rlockFile(toDir + ".lock")
+}
+
+// goldFolderPath returns the folder of the gold images, created if need be.
+func goldFolderPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", errors.Wrap(err, "can't get the home directory")
+	}
+	goldFolder := filepath.Join(home, ".terraform/virtualbox/gold")
+	return goldFolder, os.MkdirAll(goldFolder, 0740)
+}
+
+// goldName returns the name of the gold folder of the image at path.
+func goldName(path string) string {
+	name := filepath.Base(path)
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	return strings.TrimSuffix(name, ".tar")
+}
+
+func goldComplete(toDir string) bool {
+	_, err := os.Stat(filepath.Join(toDir, goldCompleteMarker))
+	return err == nil
+}
+
+// unpackImage unpacks image into the gold folder toDir, unless it is already
+// there. The image is unpacked into a temporary folder renamed into place
+// once complete.
 func unpackImage(image, toDir string) error {
-	/* Check if toDir exists */
-	_, err := os.Stat(toDir)
-	finfo, _ := ioutil.ReadDir(toDir)
-	dirEmpty := len(finfo) == 0
-	if os.IsNotExist(err) || dirEmpty {
-		err := os.MkdirAll(toDir, 0740)
-		if err != nil {
-			return err
-		}
-		fp, err := os.Open(image)
-		if err != nil {
-			return err
-		}
-		defer fp.Close()
+	return unpackImageAs(image, imageFormat(image), toDir)
+}
 
-		/* Unpack */
-		// log.Printf("[DEBUG] Unpacking Gold virtual machine into %s\n", toDir)
-		cmd := exec.Command("tar", "-xv", "-C", toDir, "-f", image)
+// unpackImageAs unpacks image of the given format into the gold folder
+// toDir, like unpackImage.
+func unpackImageAs(image, format, toDir string) error {
+	if format == imageFormatOVA || format == imageFormatOVF {
+		return fmt.Errorf("%s is an appliance, imported rather than unpacked", image)
+	}
+	if goldComplete(toDir) {
+		return nil
+	}
+
+	lock, err := lockGold(toDir)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	// Another process may have unpacked it while we waited for the lock
+	if goldComplete(toDir) {
+		return nil
+	}
+
+	tmpDir, err := ioutil.TempDir(filepath.Dir(toDir), filepath.Base(toDir)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	/* Unpack */
+	// log.Printf("[DEBUG] Unpacking Gold virtual machine into %s\n", toDir)
+	if format != imageFormatBox {
+		if err := unpackDisk(image, format, tmpDir); err != nil {
+			return errors.Wrapf(err, "unpacking disk image %s", image)
+		}
+	} else {
+		cmd := exec.Command("tar", "-xv", "-C", tmpDir, "-f", image)
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
 
 		if err := cmd.Run(); err != nil {
-			return errors.Wrapf(err, "unpacking gold image %s", fp.Name())
+			return errors.Wrapf(err, "unpacking gold image %s", image)
 		}
 	}
-	return nil
+	// Converted once, the disks are cached along with the gold image
+	if err := convertDisks(tmpDir); err != nil {
+		return errors.Wrapf(err, "converting disks of gold image %s", image)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, goldCompleteMarker), nil, 0640); err != nil {
+		return err
+	}
+
+	// Drop what an interrupted unpack left behind
+	if err := os.RemoveAll(toDir); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpDir, 0740); err != nil {
+		return err
+	}
+	return os.Rename(tmpDir, toDir)
 }
 
+// gatherDisks returns the VDI and VMDK disks under path, in any
+// subdirectory, sorted by their path relative to it.
 func gatherDisks(path string) ([]string, error) {
-	VDIs, err := filepath.Glob(filepath.Join(path, "**.vdi"))
-	if err != nil {
-		return nil, errors.Wrapf(err, "get *.vdi in '%s", path)
-	}
-	VMDKs, err := filepath.Glob(filepath.Join(path, "**.vmdk"))
+	var disks []string
+	err := filepath.Walk(path, func(disk string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		switch strings.ToLower(filepath.Ext(disk)) {
+		case ".vdi", ".vmdk":
+			if info.Mode().IsRegular() {
+				disks = append(disks, disk)
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, errors.Wrapf(err, "get *.vmdk in path '%s'", path)
+		return nil, errors.Wrapf(err, "get *.vdi and *.vmdk in path '%s'", path)
 	}
-	disks := append(VDIs, VMDKs...)
 	if len(disks) == 0 {
-		return nil, errors.Wrapf(err,
-			"no VM disk files (*.vdi, *.vmdk) found in path '%s'", path)
+		return nil, errors.Errorf("no VM disk files (*.vdi, *.vmdk) found in path '%s'", path)
 	}
+	sort.Strings(disks)
 	return disks, nil
 }
-func (img *image) verify() error {
-	// Makes sure the file cursor is positioned at the beginning of the file
-	if _, err := img.file.Seek(0, 0); err != nil {
-		return errors.Wrap(err, "can't seek image file")
+
+// verify checks the checksum of the image downloaded at path.
+func (img *image) verify(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
 	}
+	defer f.Close()
 
 	log.Printf("[DEBUG] Verifying image checksum...")
 	var hasher hash.Hash
@@ -96,12 +212,12 @@ func (img *image) verify() error {
 		return fmt.Errorf(" Crypto algorithm no supported: %s", img.ChecksumType)
 	}
 
-	if _, err := io.Copy(hasher, img.file); err != nil {
+	if _, err := io.Copy(hasher, f); err != nil {
 		return errors.Wrap(err, "cannot hash image file")
 	}
 
 	result := fmt.Sprintf("%x", hasher.Sum(nil))
-	if result != img.Checksum {
+	if result != strings.ToLower(img.Checksum) {
 		return fmt.Errorf("checksum does not match\n Result: %s\n Expected: %s", result, img.Checksum)
 	}
 
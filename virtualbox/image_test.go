@@ -2,6 +2,7 @@ package virtualbox
 
 import (
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"testing"
 
@@ -70,3 +71,96 @@ func TestUnpackImage_xz(t *testing.T) {
 
 	})
 }
+
+func TestUnpackImage_interrupted(t *testing.T) {
+	Convey("Unpack image over an interrupted unpack", t, func() {
+		dir, err := ioutil.TempDir("", "tfvbox-test-")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		gold := filepath.Join(dir, "hello")
+		So(os.Mkdir(gold, 0740), ShouldBeNil)
+		So(ioutil.WriteFile(filepath.Join(gold, "partial"), nil, 0640), ShouldBeNil)
+
+		So(unpackImage("testdata/hello.tar.gz", gold), ShouldBeNil)
+
+		Convey("The partial files should be gone", func() {
+			_, err := os.Stat(filepath.Join(gold, "partial"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+			_, err = os.Stat(filepath.Join(gold, "hello"))
+			So(err, ShouldBeNil)
+		})
+
+		Convey("A complete unpack should be kept", func() {
+			So(os.Remove(filepath.Join(gold, "hello")), ShouldBeNil)
+			So(unpackImage("testdata/hello.tar.gz", gold), ShouldBeNil)
+			_, err := os.Stat(filepath.Join(gold, "hello"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+	})
+}
+
+func TestUnpackImage_concurrent(t *testing.T) {
+	Convey("Unpack the same image concurrently", t, func() {
+		dir, err := ioutil.TempDir("", "tfvbox-test-")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		gold := filepath.Join(dir, "hello")
+
+		errs := make(chan error)
+		for i := 0; i < 4; i++ {
+			go func() { errs <- unpackImage("testdata/hello.tar.gz", gold) }()
+		}
+		for i := 0; i < 4; i++ {
+			So(<-errs, ShouldBeNil)
+		}
+
+		bytes, err := ioutil.ReadFile(filepath.Join(gold, "hello"))
+		So(err, ShouldBeNil)
+		origin, err := ioutil.ReadFile(filepath.Join("testdata", "hello"))
+		So(err, ShouldBeNil)
+		So(string(bytes), ShouldEqual, string(origin))
+
+		// Only the gold folder and its lock are left
+		entries, err := ioutil.ReadDir(dir)
+		So(err, ShouldBeNil)
+		So(entries, ShouldHaveLength, 2)
+	})
+}
+
+func TestGatherDisks(t *testing.T) {
+	Convey("Gather the disks of subdirectories in order", t, func() {
+		dir, err := ioutil.TempDir("", "tfvbox-test-")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		for _, name := range []string{"b.vmdk", "a.vdi", "data/c.VDI", "data/notes.txt", "a/d.vmdk"} {
+			So(os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755), ShouldBeNil)
+			So(ioutil.WriteFile(filepath.Join(dir, name), nil, 0644), ShouldBeNil)
+		}
+
+		disks, err := gatherDisks(dir)
+		So(err, ShouldBeNil)
+		So(disks, ShouldResemble, []string{
+			filepath.Join(dir, "a.vdi"),
+			filepath.Join(dir, "a", "d.vmdk"),
+			filepath.Join(dir, "b.vmdk"),
+			filepath.Join(dir, "data", "c.VDI"),
+		})
+
+		Convey("And find the boot disk by name or path", func() {
+			i, err := findBootDisk(dir, disks, "c.VDI")
+			So(err, ShouldBeNil)
+			So(i, ShouldEqual, 3)
+			i, err = findBootDisk(dir, disks, "a/d.vmdk")
+			So(err, ShouldBeNil)
+			So(i, ShouldEqual, 1)
+			_, err = findBootDisk(dir, disks, "e.vdi")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "a/d.vmdk")
+		})
+	})
+
+	Convey("Fail without disks", t, func() {
+		_, err := gatherDisks("testdata/vboxmanage")
+		So(err, ShouldNotBeNil)
+	})
+}
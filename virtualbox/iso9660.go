@@ -0,0 +1,279 @@
+package virtualbox
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// isoSectorSize is the logical block size used by ISO9660 images.
+const isoSectorSize = 2048
+
+// isoFile is a single file stored in the root directory of an ISO9660 image.
+type isoFile struct {
+	Name string
+	Data []byte
+}
+
+// isoImage describes a flat ISO9660 image with Joliet extensions, which is
+// all that is needed for configuration drives such as the cloud-init NoCloud
+// seed. Directories are not supported.
+type isoImage struct {
+	VolumeID string
+	Files    []isoFile
+	ModTime  time.Time
+}
+
+// Layout of the image, in sectors. Everything before the file data fits in a
+// single sector per structure as long as the root directory does.
+const (
+	isoSectorPVD = 16 + iota
+	isoSectorSVD
+	isoSectorTerminator
+	isoSectorPathL
+	isoSectorPathM
+	isoSectorJolietPathL
+	isoSectorJolietPathM
+	isoSectorRoot
+	isoSectorJolietRoot
+	isoSectorData
+)
+
+// isoEntry is a file together with its placement in the image.
+type isoEntry struct {
+	isoFile
+	extent uint32
+}
+
+// WriteTo writes the image to w.
+func (img *isoImage) WriteTo(w io.Writer) (int64, error) {
+	if len(img.Files) == 0 {
+		return 0, fmt.Errorf("ISO image %q has no files", img.VolumeID)
+	}
+	modTime := img.ModTime
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+	modTime = modTime.UTC()
+
+	entries := make([]isoEntry, 0, len(img.Files))
+	extent := uint32(isoSectorData)
+	for _, f := range img.Files {
+		entries = append(entries, isoEntry{isoFile: f, extent: extent})
+		extent += isoSectors(len(f.Data))
+	}
+	totalSectors := extent
+
+	root := isoDirectory(entries, isoSectorRoot, modTime, isoLevel1Name)
+	jolietRoot := isoDirectory(entries, isoSectorJolietRoot, modTime, isoJolietName)
+	if len(root) > isoSectorSize || len(jolietRoot) > isoSectorSize {
+		return 0, fmt.Errorf("too many files for ISO image %q", img.VolumeID)
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, int(totalSectors)*isoSectorSize))
+	buf.Write(make([]byte, isoSectorPVD*isoSectorSize)) // System area
+	buf.Write(isoVolumeDescriptor(1, img.VolumeID, totalSectors, isoSectorPathL,
+		isoSectorPathM, isoSectorRoot, len(root), modTime))
+	buf.Write(isoVolumeDescriptor(2, img.VolumeID, totalSectors, isoSectorJolietPathL,
+		isoSectorJolietPathM, isoSectorJolietRoot, len(jolietRoot), modTime))
+	buf.Write(isoPad([]byte{255, 'C', 'D', '0', '0', '1', 1}))
+	buf.Write(isoPad(isoPathTable(binary.LittleEndian, isoSectorRoot)))
+	buf.Write(isoPad(isoPathTable(binary.BigEndian, isoSectorRoot)))
+	buf.Write(isoPad(isoPathTable(binary.LittleEndian, isoSectorJolietRoot)))
+	buf.Write(isoPad(isoPathTable(binary.BigEndian, isoSectorJolietRoot)))
+	buf.Write(isoPad(root))
+	buf.Write(isoPad(jolietRoot))
+	for _, e := range entries {
+		buf.Write(isoPad(e.Data))
+	}
+
+	return buf.WriteTo(w)
+}
+
+// isoSectors returns the number of sectors needed to hold n bytes.
+func isoSectors(n int) uint32 {
+	return uint32((n + isoSectorSize - 1) / isoSectorSize)
+}
+
+// isoPad pads b with zeros up to the next sector boundary. Empty files take
+// no sector, as isoSectors counts them.
+func isoPad(b []byte) []byte {
+	if rem := len(b) % isoSectorSize; rem != 0 {
+		b = append(b, make([]byte, isoSectorSize-rem)...)
+	}
+	return b
+}
+
+// isoLevel1Name maps a file name to an ISO9660 level 1 identifier (8.3 upper
+// case d-characters), e.g. "user-data" becomes "USER_DAT.;1".
+func isoLevel1Name(name string) []byte {
+	clean := func(s string, max int) string {
+		s = strings.Map(func(r rune) rune {
+			switch {
+			case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+				return r
+			case r >= 'a' && r <= 'z':
+				return r - 'a' + 'A'
+			default:
+				return '_'
+			}
+		}, s)
+		if len(s) > max {
+			s = s[:max]
+		}
+		return s
+	}
+	base, ext := name, ""
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	return []byte(clean(base, 8) + "." + clean(ext, 3) + ";1")
+}
+
+// isoJolietName maps a file name to a Joliet (UCS-2 big endian) identifier.
+func isoJolietName(name string) []byte {
+	return isoUCS2(name)
+}
+
+func isoUCS2(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.BigEndian.PutUint16(b[2*i:], u)
+	}
+	return b
+}
+
+// isoDirectory encodes the root directory extent, files sorted by identifier.
+func isoDirectory(entries []isoEntry, self uint32, modTime time.Time, name func(string) []byte) []byte {
+	type record struct {
+		id    []byte
+		entry isoEntry
+	}
+	records := make([]record, 0, len(entries))
+	for _, e := range entries {
+		records = append(records, record{id: name(e.Name), entry: e})
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return bytes.Compare(records[i].id, records[j].id) < 0
+	})
+
+	// The size of the directory is not known before encoding it, but as it
+	// must fit a single sector it is always one sector long.
+	var dir []byte
+	dir = append(dir, isoDirRecord([]byte{0}, self, isoSectorSize, true, modTime)...)
+	dir = append(dir, isoDirRecord([]byte{1}, self, isoSectorSize, true, modTime)...)
+	for _, r := range records {
+		dir = append(dir, isoDirRecord(r.id, r.entry.extent, uint32(len(r.entry.Data)), false, modTime)...)
+	}
+	return dir
+}
+
+// isoDirRecord encodes a single directory record.
+func isoDirRecord(id []byte, extent, size uint32, dir bool, modTime time.Time) []byte {
+	length := 33 + len(id)
+	if len(id)%2 == 0 {
+		length++ // Pad to an even length
+	}
+	r := make([]byte, length)
+	r[0] = byte(length)
+	isoBothEndian32(r[2:], extent)
+	isoBothEndian32(r[10:], size)
+	copy(r[18:25], isoDirDate(modTime))
+	if dir {
+		r[25] = 2
+	}
+	isoBothEndian16(r[28:], 1)
+	r[32] = byte(len(id))
+	copy(r[33:], id)
+	return r
+}
+
+// isoPathTable encodes a path table holding the root directory only.
+func isoPathTable(order binary.ByteOrder, root uint32) []byte {
+	t := make([]byte, 10)
+	t[0] = 1
+	order.PutUint32(t[2:], root)
+	order.PutUint16(t[6:], 1)
+	return t
+}
+
+// isoVolumeDescriptor encodes the primary (kind 1) or Joliet supplementary
+// (kind 2) volume descriptor.
+func isoVolumeDescriptor(kind byte, volumeID string, sectors, pathL, pathM, root uint32,
+	rootSize int, modTime time.Time) []byte {
+	d := make([]byte, isoSectorSize)
+	d[0] = kind
+	copy(d[1:6], "CD001")
+	d[6] = 1
+
+	text := func(s string, field []byte) {
+		if kind == 2 {
+			for i := 0; i+1 < len(field); i += 2 {
+				field[i], field[i+1] = 0, ' '
+			}
+			copy(field, isoUCS2(s))
+			return
+		}
+		for i := range field {
+			field[i] = ' '
+		}
+		copy(field, s)
+	}
+	text("", d[8:40])
+	text(volumeID, d[40:72])
+	isoBothEndian32(d[80:], sectors)
+	if kind == 2 {
+		copy(d[88:], "%/E") // UCS-2 level 3
+	}
+	isoBothEndian16(d[120:], 1)
+	isoBothEndian16(d[124:], 1)
+	isoBothEndian16(d[128:], isoSectorSize)
+	isoBothEndian32(d[132:], 10)
+	binary.LittleEndian.PutUint32(d[140:], pathL)
+	binary.BigEndian.PutUint32(d[148:], pathM)
+	copy(d[156:190], isoDirRecord([]byte{0}, root, uint32(isoSectorSize*isoSectors(rootSize)), true, modTime))
+	for _, field := range [][]byte{d[190:318], d[318:446], d[446:574], d[574:702], d[702:739], d[739:776], d[776:813]} {
+		text("", field)
+	}
+	copy(d[813:830], isoVolumeDate(modTime))
+	copy(d[830:847], isoVolumeDate(modTime))
+	copy(d[847:864], isoVolumeDate(time.Time{}))
+	copy(d[864:881], isoVolumeDate(time.Time{}))
+	d[881] = 1
+	return d
+}
+
+func isoBothEndian16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+func isoBothEndian32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
+
+// isoDirDate encodes a time the way directory records expect it.
+func isoDirDate(t time.Time) []byte {
+	return []byte{
+		byte(t.Year() - 1900), byte(t.Month()), byte(t.Day()),
+		byte(t.Hour()), byte(t.Minute()), byte(t.Second()), 0,
+	}
+}
+
+// isoVolumeDate encodes a time the way volume descriptors expect it, the
+// zero time meaning "not specified".
+func isoVolumeDate(t time.Time) []byte {
+	if t.IsZero() {
+		return append([]byte("0000000000000000"), 0)
+	}
+	s := fmt.Sprintf("%04d%02d%02d%02d%02d%02d%02d", t.Year(), t.Month(), t.Day(),
+		t.Hour(), t.Minute(), t.Second(), t.Nanosecond()/1e7)
+	return append([]byte(s), 0)
+}
@@ -0,0 +1,124 @@
+package virtualbox
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// readISORoot returns the files found in the root directory described by the
+// volume descriptor at the given sector.
+func readISORoot(image []byte, descriptor int, decode func([]byte) string) map[string]string {
+	vd := image[descriptor*isoSectorSize:]
+	rootExtent := binary.LittleEndian.Uint32(vd[156+2:])
+	rootSize := binary.LittleEndian.Uint32(vd[156+10:])
+	dir := image[int(rootExtent)*isoSectorSize : int(rootExtent)*isoSectorSize+int(rootSize)]
+
+	files := make(map[string]string)
+	for len(dir) > 0 && dir[0] != 0 {
+		r := dir[:dir[0]]
+		dir = dir[dir[0]:]
+		if r[25]&2 != 0 {
+			continue // "." and ".."
+		}
+		extent := binary.LittleEndian.Uint32(r[2:])
+		size := binary.LittleEndian.Uint32(r[10:])
+		name := decode(r[33 : 33+int(r[32])])
+		files[name] = string(image[int(extent)*isoSectorSize : int(extent)*isoSectorSize+int(size)])
+	}
+	return files
+}
+
+func decodeUCS2(b []byte) string {
+	var sb strings.Builder
+	for i := 0; i+1 < len(b); i += 2 {
+		sb.WriteRune(rune(binary.BigEndian.Uint16(b[i:])))
+	}
+	return sb.String()
+}
+
+func TestISOImage_cloudInitSeed(t *testing.T) {
+	Convey("Write a NoCloud seed image", t, func() {
+		img := &isoImage{
+			VolumeID: "cidata",
+			Files: []isoFile{
+				{Name: "user-data", Data: []byte("#cloud-config\nhostname: node-01\n")},
+				{Name: "meta-data", Data: []byte("instance-id: node-01\n")},
+				{Name: "network-config", Data: bytes.Repeat([]byte("x"), 3000)},
+			},
+			ModTime: time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC),
+		}
+		var buf bytes.Buffer
+		n, err := img.WriteTo(&buf)
+		So(err, ShouldBeNil)
+		image := buf.Bytes()
+
+		Convey("The image should be made of whole sectors", func() {
+			So(n, ShouldEqual, len(image))
+			So(len(image)%isoSectorSize, ShouldEqual, 0)
+			size := binary.LittleEndian.Uint32(image[isoSectorPVD*isoSectorSize+80:])
+			So(int(size)*isoSectorSize, ShouldEqual, len(image))
+		})
+
+		Convey("The volume descriptors should carry the cidata label", func() {
+			pvd := image[isoSectorPVD*isoSectorSize:]
+			So(string(pvd[1:6]), ShouldEqual, "CD001")
+			So(strings.TrimSpace(string(pvd[40:72])), ShouldEqual, "cidata")
+
+			svd := image[isoSectorSVD*isoSectorSize:]
+			So(svd[0], ShouldEqual, 2)
+			So(string(svd[88:91]), ShouldEqual, "%/E")
+			So(strings.TrimSpace(decodeUCS2(svd[40:72])), ShouldEqual, "cidata")
+
+			So(image[isoSectorTerminator*isoSectorSize], ShouldEqual, 255)
+		})
+
+		Convey("The Joliet tree should hold the files under their real names", func() {
+			files := readISORoot(image, isoSectorSVD, decodeUCS2)
+			So(files, ShouldHaveLength, 3)
+			So(files["user-data"], ShouldEqual, "#cloud-config\nhostname: node-01\n")
+			So(files["meta-data"], ShouldEqual, "instance-id: node-01\n")
+			So(files["network-config"], ShouldEqual, strings.Repeat("x", 3000))
+		})
+
+		Convey("The primary tree should hold the files under 8.3 names", func() {
+			files := readISORoot(image, isoSectorPVD, func(b []byte) string { return string(b) })
+			So(files, ShouldHaveLength, 3)
+			So(files["USER_DAT.;1"], ShouldEqual, "#cloud-config\nhostname: node-01\n")
+			So(files["META_DAT.;1"], ShouldEqual, "instance-id: node-01\n")
+			So(files, ShouldContainKey, "NETWORK_.;1")
+		})
+	})
+
+	Convey("Place the files written after an empty file at their extents", t, func() {
+		img := &isoImage{
+			VolumeID: "cidata",
+			Files: []isoFile{
+				{Name: "user-data"},
+				{Name: "meta-data", Data: []byte("instance-id: node-01\n")},
+				{Name: "network-config", Data: []byte("version: 2\n")},
+			},
+			ModTime: time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC),
+		}
+		var buf bytes.Buffer
+		n, err := img.WriteTo(&buf)
+		So(err, ShouldBeNil)
+		image := buf.Bytes()
+		size := binary.LittleEndian.Uint32(image[isoSectorPVD*isoSectorSize+80:])
+		So(int(size)*isoSectorSize, ShouldEqual, n)
+
+		files := readISORoot(image, isoSectorSVD, decodeUCS2)
+		So(files["user-data"], ShouldBeEmpty)
+		So(files["meta-data"], ShouldEqual, "instance-id: node-01\n")
+		So(files["network-config"], ShouldEqual, "version: 2\n")
+	})
+
+	Convey("Refuse to write an image without files", t, func() {
+		_, err := (&isoImage{VolumeID: "cidata"}).WriteTo(&bytes.Buffer{})
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,47 @@
+package virtualbox
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// fileLock is a lock on a file, honoured by all the processes and goroutines
+// opening the file, so parallel Terraform runs don't step on the gold images
+// they share.
+type fileLock struct {
+	f *os.File
+}
+
+// lockFile blocks until it holds the exclusive lock of path, creating the
+// file if needed.
+func lockFile(path string) (*fileLock, error) {
+	return openLock(path, true)
+}
+
+// rlockFile blocks until it holds a shared lock of path, which excludes
+// the exclusive lock only.
+func rlockFile(path string) (*fileLock, error) {
+	return openLock(path, false)
+}
+
+func openLock(path string, exclusive bool) (*fileLock, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0640)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't open lock file %s", path)
+	}
+	if err := lockFileHandle(f, exclusive); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "can't lock %s", path)
+	}
+	return &fileLock{f: f}, nil
+}
+
+// Unlock releases the lock.
+func (l *fileLock) Unlock() error {
+	err := unlockFileHandle(l.f)
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
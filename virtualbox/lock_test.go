@@ -0,0 +1,46 @@
+package virtualbox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFileLock(t *testing.T) {
+	Convey("Shared locks exclude the exclusive lock only", t, func() {
+		dir, err := ioutil.TempDir("", "tfvbox-test-")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "gold.lock")
+
+		r1, err := rlockFile(path)
+		So(err, ShouldBeNil)
+		r2, err := rlockFile(path)
+		So(err, ShouldBeNil)
+
+		locked := make(chan *fileLock)
+		go func() {
+			l, _ := lockFile(path)
+			locked <- l
+		}()
+		select {
+		case <-locked:
+			t.Fatal("the exclusive lock was taken along shared locks")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		So(r1.Unlock(), ShouldBeNil)
+		So(r2.Unlock(), ShouldBeNil)
+		select {
+		case l := <-locked:
+			So(l, ShouldNotBeNil)
+			So(l.Unlock(), ShouldBeNil)
+		case <-time.After(time.Second):
+			t.Fatal("the exclusive lock wasn't taken once the shared locks were released")
+		}
+	})
+}
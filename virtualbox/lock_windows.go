@@ -0,0 +1,23 @@
+package virtualbox
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// The whole file is locked, as far as a 32-bit range goes.
+const lockFileRange = ^uint32(0)
+
+func lockFileHandle(f *os.File, exclusive bool) error {
+	var flags uint32
+	if exclusive {
+		flags = windows.LOCKFILE_EXCLUSIVE_LOCK
+	}
+	return windows.LockFileEx(windows.Handle(f.Fd()), flags,
+		0, lockFileRange, lockFileRange, new(windows.Overlapped))
+}
+
+func unlockFileHandle(f *os.File) error {
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, lockFileRange, lockFileRange, new(windows.Overlapped))
+}
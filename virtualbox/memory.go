@@ -0,0 +1,97 @@
+package virtualbox
+
+import (
+	"fmt"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+)
+
+// defaultMemoryMiB is the memory size of VMs configuring neither memory nor
+// memory_mb.
+const defaultMemoryMiB = 512
+
+// parseMemory parses a memory size like "512mib" or "1 GB" into MiB, the
+// unit VirtualBox expects. Sizes are rounded down to a whole MiB.
+func parseMemory(s string) (uint, error) {
+	bytes, err := humanize.ParseBytes(s)
+	if err != nil {
+		return 0, err
+	}
+	return uint(bytes / humanize.MiByte), nil
+}
+
+// formatMemory is the representation of memory sizes in the state.
+func formatMemory(mib uint) string {
+	return fmt.Sprintf("%d mib", mib)
+}
+
+// validateMemory checks the memory size can be parsed, and warns when it is
+// not a whole number of MiB.
+func validateMemory(i interface{}, k string) ([]string, []error) {
+	v, ok := i.(string)
+	if !ok {
+		return nil, []error{fmt.Errorf("expected type of %s to be string", k)}
+	}
+	bytes, err := humanize.ParseBytes(v)
+	if err != nil {
+		return nil, []error{fmt.Errorf("%s: can't parse %q as a memory size: %v", k, v, err)}
+	}
+	if bytes < humanize.MiByte {
+		return nil, []error{fmt.Errorf("%s must be at least 1 MiB, got %q", k, v)}
+	}
+	if bytes%humanize.MiByte != 0 {
+		return []string{fmt.Sprintf("%s: %q is not a whole number of MiB, it is rounded down to %s",
+			k, v, formatMemory(uint(bytes/humanize.MiByte)))}, nil
+	}
+	return nil, nil
+}
+
+// suppressMemoryDiff compares memory sizes by their value in MiB, so that
+// "512mib", "512 MiB" and "0.5 GiB" are the same.
+func suppressMemoryDiff(k, o, n string, d *schema.ResourceData) bool {
+	from, err := parseMemory(o)
+	if err != nil {
+		return false
+	}
+	to, err := parseMemory(n)
+	if err != nil {
+		return false
+	}
+	return from == to
+}
+
+// customizeDiffMemory keeps memory and memory_mb in sync: when one of them
+// changes, the other one is recomputed from the VM. The config holds memory
+// as written, so sizes are compared in MiB.
+func customizeDiffMemory(d *schema.ResourceDiff, meta interface{}) error {
+	if o, n := d.GetChange("memory"); !suppressMemoryDiff("memory", o.(string), n.(string), nil) {
+		if d.NewValueKnown("memory") && n.(string) != "" {
+			return d.SetNewComputed("memory_mb")
+		}
+	}
+	if o, n := d.GetChange("memory_mb"); o != n {
+		if err := d.SetNewComputed("memory"); err != nil {
+			return err
+		}
+		// Clearing the diff of memory also clears memory_mb, which shares
+		// its prefix.
+		return d.SetNew("memory_mb", n)
+	}
+	return nil
+}
+
+// memoryMiB returns the memory size of the VM in MiB, from memory_mb when it
+// is being changed, else from memory.
+func memoryMiB(d *schema.ResourceData) (uint, error) {
+	if mib := d.Get("memory_mb").(int); mib > 0 && d.HasChange("memory_mb") {
+		return uint(mib), nil
+	}
+	if memory := d.Get("memory").(string); memory != "" {
+		return parseMemory(memory)
+	}
+	if mib := d.Get("memory_mb").(int); mib > 0 {
+		return uint(mib), nil
+	}
+	return defaultMemoryMiB, nil
+}
@@ -0,0 +1,78 @@
+package virtualbox
+
+import (
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/terraform"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMemory(t *testing.T) {
+	Convey("Parse memory sizes in MiB", t, func() {
+		for s, mib := range map[string]uint{
+			"512mib": 512, "512 MiB": 512, "0.5 GiB": 512, "1gib": 1024, "512MB": 488,
+		} {
+			got, err := parseMemory(s)
+			So(err, ShouldBeNil)
+			So(got, ShouldEqual, mib)
+		}
+	})
+
+	Convey("Warn about sizes that aren't a whole number of MiB", t, func() {
+		warns, errs := validateMemory("512MB", "memory")
+		So(errs, ShouldBeEmpty)
+		So(warns, ShouldHaveLength, 1)
+		So(warns[0], ShouldContainSubstring, "488 mib")
+
+		warns, errs = validateMemory("0.5 GiB", "memory")
+		So(errs, ShouldBeEmpty)
+		So(warns, ShouldBeEmpty)
+	})
+
+	Convey("Plan no change for the same size in another unit", t, func() {
+		state := &terraform.InstanceState{
+			ID: "node-01",
+			Attributes: map[string]string{
+				"name": "node-01", "image": "ubuntu.box", "memory": "512 mib", "memory_mb": "512",
+			},
+		}
+		for _, memory := range []string{"512mib", "512 MiB", "0.5 GiB"} {
+			c := terraform.NewResourceConfigRaw(map[string]interface{}{
+				"name": "node-01", "image": "ubuntu.box", "memory": memory,
+			})
+			diff, err := resourceVM().Diff(state, c, nil)
+			So(err, ShouldBeNil)
+			So(diff.Attributes, ShouldNotContainKey, "memory")
+			So(diff.Attributes, ShouldNotContainKey, "memory_mb")
+		}
+
+		c := terraform.NewResourceConfigRaw(map[string]interface{}{
+			"name": "node-01", "image": "ubuntu.box", "memory_mb": 512,
+		})
+		diff, err := resourceVM().Diff(state, c, nil)
+		So(err, ShouldBeNil)
+		So(diff.Attributes, ShouldNotContainKey, "memory")
+	})
+
+	Convey("Recompute memory when memory_mb changes", t, func() {
+		state := &terraform.InstanceState{
+			ID: "node-01",
+			Attributes: map[string]string{
+				"name": "node-01", "image": "ubuntu.box", "memory": "512 mib", "memory_mb": "512",
+			},
+		}
+		c := terraform.NewResourceConfigRaw(map[string]interface{}{
+			"name": "node-01", "image": "ubuntu.box", "memory_mb": 1024,
+		})
+		diff, err := resourceVM().Diff(state, c, nil)
+		So(err, ShouldBeNil)
+		So(diff.Attributes["memory_mb"].New, ShouldEqual, "1024")
+		So(diff.Attributes["memory"].NewComputed, ShouldBeTrue)
+	})
+
+	Convey("Reject memory and memory_mb together", t, func() {
+		So(planVM(map[string]interface{}{
+			"name": "node-01", "image": "ubuntu.box", "memory": "1gib", "memory_mb": 1024,
+		}), ShouldNotBeNil)
+	})
+}
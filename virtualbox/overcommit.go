@@ -0,0 +1,109 @@
+package virtualbox
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+	vbox "github.com/terra-farm/go-virtualbox"
+)
+
+// Values of the overcommit_policy provider setting. There is no warning
+// policy: CustomizeDiff can only fail the plan, warnings would only show in
+// the logs.
+const (
+	overcommitIgnore = "ignore"
+	overcommitFail   = "fail"
+)
+
+var validOvercommitPolicies = []string{overcommitIgnore, overcommitFail}
+
+// checkOvercommit returns an error when the VM, added to the running VMs,
+// needs more CPUs or memory than the host has.
+func checkOvercommit(host *hostInfo, running []*vbox.Machine, cpus, memoryMiB uint) error {
+	for _, vm := range running {
+		cpus += vm.CPUs
+		memoryMiB += vm.Memory
+	}
+	if cpus > uint(host.CPUs) {
+		return fmt.Errorf("running VMs would use %d CPUs, the host has %d", cpus, host.CPUs)
+	}
+	if uint64(memoryMiB) > host.MemoryTotalMB {
+		return fmt.Errorf("running VMs would use %d MiB of memory, the host has %d MiB",
+			memoryMiB, host.MemoryTotalMB)
+	}
+	return nil
+}
+
+// plannedMemoryMiB returns the memory size of the planned VM, false when it
+// is not known yet. Unset, it is only known once VMs keeping the hardware of
+// their appliance are imported.
+func plannedMemoryMiB(d *schema.ResourceDiff) (uint, bool) {
+	if mib := d.Get("memory_mb").(int); mib > 0 {
+		return uint(mib), true
+	}
+	if memory := d.Get("memory").(string); memory != "" {
+		mib, err := parseMemory(memory)
+		return mib, err == nil
+	}
+	if keepsApplianceHardware(d.Get) {
+		return 0, false
+	}
+	return defaultMemoryMiB, true
+}
+
+// plannedCPUs returns the CPUs of the planned VM, false when they are not
+// known yet.
+func plannedCPUs(d *schema.ResourceDiff) (uint, bool) {
+	if cpus := d.Get("cpus").(int); cpus > 0 {
+		return uint(cpus), true
+	}
+	if keepsApplianceHardware(d.Get) {
+		return 0, false
+	}
+	return defaultCPUs, true
+}
+
+// customizeDiffOvercommit checks that the host can run the VM alongside the
+// running VMs, following the overcommit_policy of the provider.
+func customizeDiffOvercommit(d *schema.ResourceDiff, meta interface{}) error {
+	config, ok := meta.(*providerConfig)
+	if !ok || config.OvercommitPolicy == overcommitIgnore {
+		return nil
+	}
+	if d.Get("status").(string) != "running" {
+		return nil
+	}
+	if d.Id() != "" && !d.HasChange("cpus") && !d.HasChange("memory") &&
+		!d.HasChange("memory_mb") && !d.HasChange("status") {
+		return nil
+	}
+	memoryMiB, ok := plannedMemoryMiB(d)
+	if !ok {
+		return nil
+	}
+	cpus, ok := plannedCPUs(d)
+	if !ok {
+		return nil
+	}
+
+	host, err := getHostInfo()
+	if err != nil {
+		return errLogf("unable to get host info: %v", err)
+	}
+	vms, err := getRunningVMs()
+	if err != nil {
+		return errLogf("unable to list running VMs: %v", err)
+	}
+	// The VM itself is replaced by its planned size
+	running := vms[:0]
+	for _, vm := range vms {
+		if vm.UUID != d.Id() {
+			running = append(running, vm)
+		}
+	}
+
+	if err := checkOvercommit(host, running, cpus, memoryMiB); err != nil {
+		return fmt.Errorf("VM %s overcommits the host: %v", d.Get("name"), err)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package virtualbox
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/resource"
+	"github.com/hashicorp/terraform-plugin-sdk/terraform"
+	. "github.com/smartystreets/goconvey/convey"
+	vbox "github.com/terra-farm/go-virtualbox"
+)
+
+func TestOvercommit(t *testing.T) {
+	host := &hostInfo{CPUs: 8, CPUCores: 4, MemoryTotalMB: 16384}
+
+	Convey("Parse list runningvms", t, func() {
+		So(parseRunningVMs("\"node-01\" {0b3a5bd2-2d0e-4d5a-a3b5-6f5e2d1c1f11}\n"+
+			"\"my \\\"vm\\\"\" {4c1d0b4e-5e64-4bd0-9a5d-86a1c1f7a4b2}\n"), ShouldResemble, []string{
+			"0b3a5bd2-2d0e-4d5a-a3b5-6f5e2d1c1f11", "4c1d0b4e-5e64-4bd0-9a5d-86a1c1f7a4b2",
+		})
+		So(parseRunningVMs(""), ShouldBeEmpty)
+	})
+
+	Convey("Accept VMs fitting on the host", t, func() {
+		running := []*vbox.Machine{{CPUs: 2, Memory: 4096}, {CPUs: 2, Memory: 4096}}
+		So(checkOvercommit(host, running, 4, 8192), ShouldBeNil)
+	})
+
+	Convey("Reject VMs exceeding the host CPUs", t, func() {
+		running := []*vbox.Machine{{CPUs: 6, Memory: 1024}}
+		err := checkOvercommit(host, running, 4, 1024)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "10 CPUs")
+	})
+
+	Convey("Reject VMs exceeding the host memory", t, func() {
+		running := []*vbox.Machine{{CPUs: 1, Memory: 12288}}
+		err := checkOvercommit(host, running, 1, 8192)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "20480 MiB")
+	})
+
+	Convey("Skip the check unless the provider opts in", t, func() {
+		c := terraform.NewResourceConfigRaw(map[string]interface{}{
+			"name": "node-01", "image": "ubuntu.box", "cpus": 1024,
+		})
+		for _, meta := range []interface{}{nil, &providerConfig{OvercommitPolicy: overcommitIgnore}} {
+			_, err := resourceVM().Diff(nil, c, meta)
+			So(err, ShouldBeNil)
+		}
+	})
+}
+
+func TestResourceVM_overcommit(t *testing.T) {
+	fake := newFakeVBoxManage(t)
+	hostinfo, err := ioutil.ReadFile(filepath.Join("testdata", "vboxmanage", "list_hostinfo.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.script(t, fakeCommand{Args: []string{"list", "hostinfo"}, Stdout: string(hostinfo)})
+	config := func(policy string) string {
+		return `
+provider "virtualbox" {
+  overcommit_policy = "` + policy + `"
+}
+` + testVMConfig("ubuntu.box", "cpus = 16")
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		Providers: testProviders(),
+		Steps: []resource.TestStep{
+			{
+				// Warnings would only show in the logs
+				Config:             config("warn"),
+				PlanOnly:           true,
+				ExpectNonEmptyPlan: true,
+				ExpectError:        regexp.MustCompile(`expected overcommit_policy to be one of \[ignore fail\]`),
+			},
+			{
+				Config:             config("fail"),
+				PlanOnly:           true,
+				ExpectNonEmptyPlan: true,
+				ExpectError:        regexp.MustCompile("VM node-01 overcommits the host: running VMs would use 16 CPUs, the host has 8"),
+			},
+		},
+	})
+	if err := testCheckFakeNotCalled(t, fake, "import")(nil); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,115 @@
+package virtualbox
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	vbox "github.com/terra-farm/go-virtualbox"
+)
+
+// validateExtraData rejects the extradata keys managed by other attributes.
+func validateExtraData(i interface{}, k string) ([]string, []error) {
+	m, ok := i.(map[string]interface{})
+	if !ok {
+		return nil, []error{fmt.Errorf("expected type of %s to be map", k)}
+	}
+	if _, ok := m["user_data"]; ok {
+		return nil, []error{fmt.Errorf("%s can't set the \"user_data\" key, use the user_data attribute", k)}
+	}
+	return nil, nil
+}
+
+// sortedKeys returns the keys of a map attribute in a stable order, so that
+// VBoxManage is called in the same order on every run.
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// applyMapChange sets the keys added or changed between from and to, and
+// deletes the keys that were removed.
+func applyMapChange(from, to map[string]interface{},
+	set func(key, value string) error, del func(key string) error) error {
+	for _, key := range sortedKeys(from) {
+		if _, ok := to[key]; ok {
+			continue
+		}
+		if err := del(key); err != nil {
+			return errors.Wrapf(err, "can't delete %q", key)
+		}
+	}
+	for _, key := range sortedKeys(to) {
+		value := to[key].(string)
+		if oldValue, ok := from[key]; ok && oldValue.(string) == value {
+			continue
+		}
+		if err := set(key, value); err != nil {
+			return errors.Wrapf(err, "can't set %q", key)
+		}
+	}
+	return nil
+}
+
+// applyExtraData updates the VM extradata from one map to the other.
+func applyExtraData(vm *vbox.Machine, from, to map[string]interface{}) error {
+	return applyMapChange(from, to, vm.SetExtraData, vm.DeleteExtraData)
+}
+
+// applyGuestProperties updates the VM guest properties from one map to the other.
+func applyGuestProperties(vm *vbox.Machine, from, to map[string]interface{}) error {
+	return applyMapChange(from, to,
+		func(key, value string) error { return vbox.SetGuestProperty(vm.UUID, key, value) },
+		func(key string) error { return vbox.DeleteGuestProperty(vm.UUID, key) })
+}
+
+// readExtraData reads back the given extradata keys, leaving out the ones
+// which are no longer set.
+func readExtraData(vm *vbox.Machine, keys []string) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		value, err := vm.GetExtraData(key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "can't get extradata %q", key)
+		}
+		if value != nil {
+			out[key] = *value
+		}
+	}
+	return out, nil
+}
+
+// readGuestProperties reads back the given guest properties, leaving out the
+// ones which are no longer set.
+func readGuestProperties(vm *vbox.Machine, keys []string) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		value, ok, err := getGuestProperty(vm.UUID, key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "can't get guest property %q", key)
+		}
+		if ok {
+			out[key] = value
+		}
+	}
+	return out, nil
+}
+
+// getGuestProperty reads a guest property, reporting whether it is set.
+// Unlike vbox.GetGuestProperty, a missing property is not an error.
+func getGuestProperty(vm, key string) (string, bool, error) {
+	out, err := vboxManage("guestproperty", "get", vm, key)
+	if err != nil {
+		return "", false, err
+	}
+	// A missing property is reported as "No value set!"
+	if !strings.HasPrefix(out, "Value: ") {
+		return "", false, nil
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(out, "Value: "), "\n"), true, nil
+}
@@ -9,10 +9,15 @@ package virtualbox
 import (
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/helper/validation"
 	"github.com/hashicorp/terraform-plugin-sdk/terraform"
+	"github.com/pkg/errors"
 )
 
 func init() {
@@ -24,8 +29,307 @@ func init() {
 // Provider returns a resource provider for virtualbox.
 func Provider() terraform.ResourceProvider {
 	return &schema.Provider{
+		Schema: map[string]*schema.Schema{
+
+			"overcommit_policy": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      overcommitIgnore,
+				Description:  "What to do when running VMs would exceed the host CPUs or memory",
+				ValidateFunc: validation.StringInSlice(validOvercommitPolicies, false),
+			},
+
+			"max_parallel_clones": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      1,
+				Description:  "Maximum number of disks cloned at the same time",
+				ValidateFunc: validation.IntAtLeast(1),
+			},
+
+			"cache_dir": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Directory of the downloaded images, ~/.terraform/virtualbox/cache by default",
+			},
+
+			"download": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				MaxItems:    1,
+				Description: "Settings of the image downloads",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"bearer_token": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Sensitive:   true,
+							Description: "Token sent as bearer authorization",
+						},
+						"username": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "User name of the basic authentication",
+						},
+						"password": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Sensitive:   true,
+							Description: "Password of the basic authentication",
+						},
+						"netrc": {
+							Type:        schema.TypeBool,
+							Optional:    true,
+							Description: "Look the credentials up in the netrc file",
+						},
+						"netrc_file": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "netrc file, $NETRC or ~/.netrc by default",
+						},
+						"headers": {
+							Type:        schema.TypeMap,
+							Optional:    true,
+							Sensitive:   true,
+							Description: "Headers sent with the requests",
+							Elem:        &schema.Schema{Type: schema.TypeString},
+						},
+						"ca_file": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "PEM bundle of the CAs trusted along with the system ones",
+						},
+						"insecure_skip_verify": {
+							Type:        schema.TypeBool,
+							Optional:    true,
+							Description: "Don't verify the TLS certificates",
+						},
+						"proxy": {
+							Type:         schema.TypeString,
+							Optional:     true,
+							Description:  "URL of the proxy, the HTTP_PROXY and HTTPS_PROXY environment variables are used if not set",
+							ValidateFunc: validation.IsURLWithScheme([]string{"http", "https", "socks5"}),
+						},
+						"timeout": {
+							Type:         schema.TypeString,
+							Optional:     true,
+							Description:  "Time to connect and get the response headers, like \"30s\"",
+							ValidateFunc: validateDuration,
+						},
+					},
+				},
+			},
+
+			"s3": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				MaxItems:    1,
+				Description: "Settings of the s3:// images",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"endpoint": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "URL of an S3-compatible service, like a local MinIO, addressed with path-style requests",
+						},
+						"region": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Default:     "us-east-1",
+							Description: "Region of the buckets",
+						},
+						"access_key": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "Access key, the AWS credential chain is used if not set",
+						},
+						"secret_key": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Sensitive:   true,
+							Description: "Secret key",
+						},
+						"session_token": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Sensitive:   true,
+							Description: "Session token of temporary credentials",
+						},
+					},
+				},
+			},
+
+			"sftp": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				MaxItems:    1,
+				Description: "Settings of the sftp:// images",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"user": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "User name, if not in the URL",
+						},
+						"password": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Sensitive:   true,
+							Description: "Password",
+						},
+						"private_key": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Sensitive:   true,
+							Description: "PEM-encoded private key",
+						},
+						"known_hosts_file": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "known_hosts file checking the host keys, ~/.ssh/known_hosts by default",
+						},
+						"insecure_ignore_host_key": {
+							Type:        schema.TypeBool,
+							Optional:    true,
+							Description: "Don't check the host keys",
+						},
+					},
+				},
+			},
+		},
+		ConfigureFunc: providerConfigure,
+		DataSourcesMap: map[string]*schema.Resource{
+			"virtualbox_vm":   dataSourceVM(),
+			"virtualbox_host": dataSourceHost(),
+		},
 		ResourcesMap: map[string]*schema.Resource{
-			"virtualbox_vm": resourceVM(),
+			"virtualbox_vm":       resourceVM(),
+			"virtualbox_snapshot": resourceSnapshot(),
+			"virtualbox_image":    resourceImage(),
 		},
 	}
 }
+
+// providerConfig is the provider configuration, passed to the resources as
+// their meta.
+type providerConfig struct {
+	OvercommitPolicy string
+
+	// CacheDir holds the downloaded images
+	CacheDir string
+
+	// Settings and credentials of the image fetchers
+	Download downloadConfig
+	S3       s3Config
+	SFTP     sftpConfig
+
+	// downloader is the HTTP client of the image fetches
+	downloader *http.Client
+
+	// cloneSlots bounds the number of parallel disk clones
+	cloneSlots chan struct{}
+}
+
+// s3Config is the s3 block of the provider.
+type s3Config struct {
+	Endpoint     string
+	Region       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+}
+
+// sftpConfig is the sftp block of the provider.
+type sftpConfig struct {
+	User                  string
+	Password              string
+	PrivateKey            string
+	KnownHostsFile        string
+	InsecureIgnoreHostKey bool
+}
+
+func providerConfigure(d *schema.ResourceData) (interface{}, error) {
+	config := &providerConfig{
+		OvercommitPolicy: d.Get("overcommit_policy").(string),
+		CacheDir:         d.Get("cache_dir").(string),
+		S3:               s3Config{Region: "us-east-1"},
+		cloneSlots:       make(chan struct{}, d.Get("max_parallel_clones").(int)),
+	}
+	if blocks := d.Get("download").([]interface{}); len(blocks) > 0 && blocks[0] != nil {
+		block := blocks[0].(map[string]interface{})
+		config.Download = downloadConfig{
+			BearerToken:        block["bearer_token"].(string),
+			Username:           block["username"].(string),
+			Password:           block["password"].(string),
+			Netrc:              block["netrc"].(bool),
+			NetrcFile:          block["netrc_file"].(string),
+			Headers:            make(map[string]string),
+			CAFile:             block["ca_file"].(string),
+			InsecureSkipVerify: block["insecure_skip_verify"].(bool),
+			Proxy:              block["proxy"].(string),
+		}
+		for name, value := range block["headers"].(map[string]interface{}) {
+			config.Download.Headers[name] = value.(string)
+		}
+		if timeout := block["timeout"].(string); timeout != "" {
+			config.Download.Timeout, _ = time.ParseDuration(timeout)
+		}
+	}
+	downloader, err := config.Download.client()
+	if err != nil {
+		return nil, err
+	}
+	config.downloader = downloader
+	if blocks := d.Get("s3").([]interface{}); len(blocks) > 0 && blocks[0] != nil {
+		block := blocks[0].(map[string]interface{})
+		config.S3 = s3Config{
+			Endpoint:     block["endpoint"].(string),
+			Region:       block["region"].(string),
+			AccessKey:    block["access_key"].(string),
+			SecretKey:    block["secret_key"].(string),
+			SessionToken: block["session_token"].(string),
+		}
+	}
+	if blocks := d.Get("sftp").([]interface{}); len(blocks) > 0 && blocks[0] != nil {
+		block := blocks[0].(map[string]interface{})
+		config.SFTP = sftpConfig{
+			User:                  block["user"].(string),
+			Password:              block["password"].(string),
+			PrivateKey:            block["private_key"].(string),
+			KnownHostsFile:        block["known_hosts_file"].(string),
+			InsecureIgnoreHostKey: block["insecure_ignore_host_key"].(bool),
+		}
+	}
+	return config, nil
+}
+
+// downloadClient returns the HTTP client of the image fetches, the default
+// one without provider config.
+func (c *providerConfig) downloadClient() *http.Client {
+	if c == nil || c.downloader == nil {
+		return http.DefaultClient
+	}
+	return c.downloader
+}
+
+// cacheFolder returns the directory of the downloaded images.
+func (c *providerConfig) cacheFolder() (string, error) {
+	if c != nil && c.CacheDir != "" {
+		return c.CacheDir, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", errors.Wrap(err, "can't get the home directory")
+	}
+	return filepath.Join(home, ".terraform/virtualbox/cache"), nil
+}
+
+// acquireClone blocks until a disk can be cloned and returns the function
+// releasing its slot. Clones are not bounded without a provider config.
+func (c *providerConfig) acquireClone() func() {
+	if c == nil || c.cloneSlots == nil {
+		return func() {}
+	}
+	c.cloneSlots <- struct{}{}
+	return func() { <-c.cloneSlots }
+}
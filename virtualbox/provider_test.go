@@ -0,0 +1,99 @@
+package virtualbox
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestProvider(t *testing.T) {
+	Convey("The provider schema should be valid", t, func() {
+		So(Provider().(*schema.Provider).InternalValidate(), ShouldBeNil)
+	})
+
+	Convey("Bound parallel clones", t, func() {
+		d := schema.TestResourceDataRaw(t, Provider().(*schema.Provider).Schema, map[string]interface{}{
+			"max_parallel_clones": 2,
+		})
+		meta, err := providerConfigure(d)
+		So(err, ShouldBeNil)
+		config := meta.(*providerConfig)
+
+		release := config.acquireClone()
+		config.acquireClone()
+		acquired := make(chan struct{})
+		go func() {
+			config.acquireClone()
+			close(acquired)
+		}()
+
+		select {
+		case <-acquired:
+			t.Fatal("a third clone started")
+		case <-time.After(50 * time.Millisecond):
+		}
+		release()
+		select {
+		case <-acquired:
+		case <-time.After(time.Second):
+			t.Fatal("the third clone didn't start once a slot was released")
+		}
+	})
+
+	Convey("Read the credentials of the fetchers", t, func() {
+		d := schema.TestResourceDataRaw(t, Provider().(*schema.Provider).Schema, map[string]interface{}{
+			"s3": []interface{}{map[string]interface{}{
+				"endpoint": "http://localhost:9000", "access_key": "minio", "secret_key": "minio123",
+			}},
+			"sftp": []interface{}{map[string]interface{}{"user": "vagrant", "insecure_ignore_host_key": true}},
+		})
+		meta, err := providerConfigure(d)
+		So(err, ShouldBeNil)
+		config := meta.(*providerConfig)
+		So(config.S3, ShouldResemble, s3Config{
+			Endpoint: "http://localhost:9000", Region: "us-east-1", AccessKey: "minio", SecretKey: "minio123",
+		})
+		So(config.SFTP, ShouldResemble, sftpConfig{User: "vagrant", InsecureIgnoreHostKey: true})
+	})
+
+	Convey("Read the download settings", t, func() {
+		d := schema.TestResourceDataRaw(t, Provider().(*schema.Provider).Schema, map[string]interface{}{
+			"download": []interface{}{map[string]interface{}{
+				"username": "ci", "password": "s3cret", "headers": map[string]interface{}{"X-Api-Key": "key"},
+				"proxy": "http://proxy:3128", "timeout": "30s",
+			}},
+		})
+		meta, err := providerConfigure(d)
+		So(err, ShouldBeNil)
+		config := meta.(*providerConfig)
+		So(config.Download, ShouldResemble, downloadConfig{
+			Username: "ci", Password: "s3cret", Headers: map[string]string{"X-Api-Key": "key"},
+			Proxy: "http://proxy:3128", Timeout: 30 * time.Second,
+		})
+		So(config.downloadClient(), ShouldNotEqual, http.DefaultClient)
+	})
+
+	Convey("Download images into the cache directory", t, func() {
+		home, err := os.UserHomeDir()
+		So(err, ShouldBeNil)
+		var config *providerConfig
+		dir, err := config.cacheFolder()
+		So(err, ShouldBeNil)
+		So(dir, ShouldEqual, filepath.Join(home, ".terraform", "virtualbox", "cache"))
+
+		config = &providerConfig{CacheDir: "/var/cache/boxes"}
+		dir, err = config.cacheFolder()
+		So(err, ShouldBeNil)
+		So(dir, ShouldEqual, "/var/cache/boxes")
+	})
+
+	Convey("Don't bound clones without provider config", t, func() {
+		var config *providerConfig
+		config.acquireClone()()
+	})
+}
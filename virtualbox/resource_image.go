@@ -0,0 +1,332 @@
+package virtualbox
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/customdiff"
+	"github.com/hashicorp/terraform-plugin-sdk/helper/resource"
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/helper/validation"
+)
+
+func resourceImage() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceImageCreate,
+		Read:   resourceImageRead,
+		Delete: resourceImageDelete,
+		CustomizeDiff: customdiff.All(
+			customizeDiffChecksum,
+			customizeDiffSignature,
+		),
+
+		Schema: map[string]*schema.Schema{
+
+			"source": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "Path or URL of the image",
+			},
+
+			"checksum": {
+				Type:     schema.TypeString,
+				Optional: true,
+				ForceNew: true,
+			},
+
+			"checksum_type": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     true,
+				ValidateFunc: validation.StringInSlice(validChecksumTypes, false),
+			},
+
+			"signature_url": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				ForceNew:    true,
+				Description: "URL of the detached signature of the image, or of a checksum file listing it",
+			},
+
+			"public_key": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				ForceNew:    true,
+				Description: "Armored OpenPGP or minisign public key trusted to sign the image",
+			},
+
+			"format": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Computed:     true,
+				ForceNew:     true,
+				Description:  "Format of the image, told by its extension if not set",
+				ValidateFunc: validation.StringInSlice(validImageFormats, false),
+			},
+
+			"path": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Gold folder of the unpacked image, or file of the appliance, to set as virtualbox_vm.image",
+			},
+
+			"disks": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "Disks of the gold folder",
+				Elem:        &schema.Schema{Type: schema.TypeString},
+			},
+
+			"size": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Size in bytes of the unpacked image, a string not to overflow int on 32-bit platforms",
+			},
+		},
+	}
+}
+
+// isApplianceFormat tells whether images of the format are imported as
+// appliances rather than unpacked.
+func isApplianceFormat(format string) bool {
+	return format == imageFormatOVA || format == imageFormatOVF
+}
+
+func resourceImageCreate(d *schema.ResourceData, meta interface{}) error {
+	config, _ := meta.(*providerConfig)
+	img := &image{
+		URL:          d.Get("source").(string),
+		Checksum:     d.Get("checksum").(string),
+		ChecksumType: d.Get("checksum_type").(string),
+		SignatureURL: d.Get("signature_url").(string),
+		PublicKey:    d.Get("public_key").(string),
+	}
+	u, err := url.Parse(img.URL)
+	if err != nil {
+		return errLogf("Parsing image URL %s: %v", img.URL, err)
+	}
+	imagePath, err := fetchIfRemote(config, img)
+	if err != nil {
+		return errLogf("Fetching image %s: %v", displayURL(u), err)
+	}
+
+	format := d.Get("format").(string)
+	if format == "" {
+		format = imageFormat(imagePath)
+	}
+	// Images of the same source, checksum and format share their gold
+	// folder, which each of them holds until destroyed
+	key := sha256.Sum256([]byte(displayURL(u) + "\n" + img.ChecksumType + ":" + img.Checksum + "\n" + format))
+	name := goldName(imagePath) + "-" + hex.EncodeToString(key[:8])
+	id := resource.PrefixedUniqueId(name + "-")
+
+	goldFolder, err := goldFolderPath()
+	if err != nil {
+		return errLogf("Unable to create gold folder: %v", err)
+	}
+	path := filepath.Join(goldFolder, name)
+	switch {
+	case !isApplianceFormat(format):
+		if err := holdGold(path, id); err != nil {
+			return errLogf("Holding gold image %s: %v", path, err)
+		}
+		if err := unpackImageAs(imagePath, format, path); err != nil {
+			releaseGold(path, id)
+			return errLogf("Unpacking image %s: %v", imagePath, err)
+		}
+	case imageFormat(imagePath) == format:
+		path = imagePath
+		// Downloaded appliances are removed along with their last image
+		if isRemote(u) {
+			if err := holdGold(path, id); err != nil {
+				return errLogf("Holding appliance %s: %v", path, err)
+			}
+		}
+	case format == imageFormatOVF:
+		// The disks of the appliance are next to it
+		return errLogf("Image %s must end in .ovf to be imported", imagePath)
+	default:
+		// VMs tell appliances by their extension
+		path += "." + format
+		if err := holdGold(path, id); err != nil {
+			return errLogf("Holding appliance link %s: %v", path, err)
+		}
+		if err := linkAppliance(imagePath, path); err != nil {
+			releaseGold(path, id)
+			return errLogf("Linking appliance %s: %v", imagePath, err)
+		}
+	}
+
+	d.SetId(id)
+	if err := d.Set("format", format); err != nil {
+		return errLogf("Setting format: %v", err)
+	}
+	if err := d.Set("path", path); err != nil {
+		return errLogf("Setting path: %v", err)
+	}
+	return resourceImageRead(d, meta)
+}
+
+// linkAppliance links the appliance at path into the gold folder, or copies
+// it there if it is on another file system.
+func linkAppliance(image, path string) error {
+	if err := os.Link(image, path); err == nil || os.IsExist(err) {
+		return nil
+	}
+	return copyFile(image, path)
+}
+
+// imageSize returns the size in bytes of the files under path.
+func imageSize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+func resourceImageRead(d *schema.ResourceData, meta interface{}) error {
+	path := d.Get("path").(string)
+	appliance := isApplianceFormat(d.Get("format").(string))
+
+	// Removed behind Terraform's back
+	exists := goldComplete(path)
+	if appliance {
+		_, err := os.Stat(path)
+		exists = err == nil
+	}
+	if !exists {
+		log.Printf("[WARN] Image %s is gone, removing it from the state", path)
+		d.SetId("")
+		return nil
+	}
+
+	disks := []string{}
+	if !appliance {
+		var err error
+		if disks, err = gatherDisks(path); err != nil {
+			return errLogf("Unable to gather disks: %v", err)
+		}
+	}
+	if err := d.Set("disks", disks); err != nil {
+		return errLogf("Setting disks: %v", err)
+	}
+	size, err := imageSize(path)
+	if err != nil {
+		return errLogf("Measuring image %s: %v", path, err)
+	}
+	if err := d.Set("size", strconv.FormatInt(size, 10)); err != nil {
+		return errLogf("Setting size: %v", err)
+	}
+	return nil
+}
+
+// goldHolders returns the folder listing the virtualbox_image resources
+// holding the gold image or appliance link at path.
+func goldHolders(path string) string {
+	return path + ".holders"
+}
+
+// holdGold records that the resource id holds the gold image at path, so
+// that other resources of the same image leave it in place when destroyed.
+func holdGold(path, id string) error {
+	lock, err := lockGold(path)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	if err := os.MkdirAll(goldHolders(path), 0740); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(goldHolders(path), id), nil, 0640)
+}
+
+// releaseGold releases the gold image at path held by the resource id, and
+// removes it once the last holder released it and the VMs cloning it are
+// done. It tells whether the gold image was removed.
+func releaseGold(path, id string) (bool, error) {
+	lock, err := lockGold(path)
+	if err != nil {
+		return false, err
+	}
+	defer lock.Unlock()
+	if err := os.Remove(filepath.Join(goldHolders(path), id)); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	holders, err := ioutil.ReadDir(goldHolders(path))
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if len(holders) > 0 {
+		log.Printf("[DEBUG] Gold image %s is still held by %d images", path, len(holders))
+		return false, nil
+	}
+	if err := os.RemoveAll(path); err != nil {
+		return false, err
+	}
+	return true, os.RemoveAll(goldHolders(path))
+}
+
+// removeDownload removes the download of the image at u from the cache,
+// leaving its lock in place for the processes waiting on it.
+func removeDownload(config *providerConfig, u *url.URL) error {
+	file, err := cachePath(config, u)
+	if err != nil {
+		return err
+	}
+	lock, err := lockFile(file + ".lock")
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	for _, path := range []string{file, file + ".json"} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func resourceImageDelete(d *schema.ResourceData, meta interface{}) error {
+	config, _ := meta.(*providerConfig)
+	path := d.Get("path").(string)
+	u, err := url.Parse(d.Get("source").(string))
+	if err != nil {
+		return errLogf("Parsing image URL: %v", err)
+	}
+	goldFolder, err := goldFolderPath()
+	if err != nil {
+		return errLogf("Unable to create gold folder: %v", err)
+	}
+	// Local appliances used in place belong to the user
+	if filepath.Dir(path) != goldFolder && !isRemote(u) {
+		return nil
+	}
+	removed, err := releaseGold(path, d.Id())
+	if err != nil {
+		return errLogf("Removing gold image %s: %v", path, err)
+	}
+
+	// Local sources belong to the user, only downloads are removed, along
+	// with the last image of them
+	if !removed || !isRemote(u) {
+		return nil
+	}
+	if err := removeDownload(config, u); err != nil {
+		return errLogf("Removing download of %s: %v", displayURL(u), err)
+	}
+	return nil
+}
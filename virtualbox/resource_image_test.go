@@ -0,0 +1,270 @@
+package virtualbox
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/resource"
+	"github.com/hashicorp/terraform-plugin-sdk/terraform"
+)
+
+func testImageConfig(source, extra string) string {
+	return fmt.Sprintf(`
+resource "virtualbox_image" "ubuntu" {
+  source = %q
+  %s
+}
+`, source, extra)
+}
+
+// testCheckImagePath checks that the path of the image is under the gold
+// folder and passes it to check.
+func testCheckImagePath(name string, check func(path string) error) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		rs, ok := s.RootModule().Resources[name]
+		if !ok {
+			return fmt.Errorf("%s not found", name)
+		}
+		path := rs.Primary.Attributes["path"]
+		gold, err := goldFolderPath()
+		if err != nil {
+			return err
+		}
+		if filepath.Dir(path) != gold {
+			return fmt.Errorf("image %s is not in the gold folder %s", path, gold)
+		}
+		return check(path)
+	}
+}
+
+// testCheckImagesDeleted checks that no image is left in the gold folder.
+func testCheckImagesDeleted(*terraform.State) error {
+	gold, err := goldFolderPath()
+	if err != nil {
+		return err
+	}
+	images, err := filepath.Glob(filepath.Join(gold, "*-*"))
+	if err != nil {
+		return err
+	}
+	for _, image := range images {
+		if !strings.HasSuffix(image, ".lock") {
+			return fmt.Errorf("image %s was not deleted", image)
+		}
+	}
+	return nil
+}
+
+func TestResourceImage_vm(t *testing.T) {
+	fake := newFakeVBoxManage(t)
+	image, baseFolder := setupTestImage(t)
+	fake.script(t, fakeVMLifecycle(baseFolder, natVMInfo, natVMGuestInfo)...)
+
+	resource.UnitTest(t, resource.TestCase{
+		Providers: testProviders(),
+		CheckDestroy: resource.ComposeTestCheckFunc(
+			testCheckFakeDeleted(t, fake),
+			testCheckImagesDeleted,
+		),
+		Steps: []resource.TestStep{
+			{
+				Config: testImageConfig(image, "") +
+					strings.Replace(testVMConfig(image, ""), fmt.Sprintf("%q", image), "virtualbox_image.ubuntu.path", 1),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("virtualbox_image.ubuntu", "format", "box"),
+					resource.TestCheckResourceAttr("virtualbox_image.ubuntu", "disks.#", "1"),
+					resource.TestMatchResourceAttr("virtualbox_image.ubuntu", "disks.0", regexp.MustCompile(`box-disk001\.vmdk$`)),
+					resource.TestCheckResourceAttr("virtualbox_image.ubuntu", "size", "0"),
+					testCheckImagePath("virtualbox_image.ubuntu", func(path string) error {
+						if !strings.HasPrefix(filepath.Base(path), "ubuntu-") {
+							return fmt.Errorf("image %s is not named after its source", path)
+						}
+						// The VM clones the disks of the image rather than unpacking
+						// a gold image of its own
+						if _, err := os.Stat(filepath.Join(filepath.Dir(path), "ubuntu")); !os.IsNotExist(err) {
+							return fmt.Errorf("the VM unpacked the image again: %v", err)
+						}
+						return testCheckFakeCalled(t, fake, "clonehd "+filepath.Join(baseFolder, "gold-box-disk001.vmdk"))(nil)
+					}),
+				),
+			},
+		},
+	})
+}
+
+func TestResourceImage_format(t *testing.T) {
+	fake := newFakeVBoxManage(t)
+	_, _ = setupTestImage(t)
+	fake.script(t, fakeCommand{Args: []string{"convertfromraw"}, CreateArgs: []int{2}})
+	image := filepath.Join(os.Getenv("HOME"), "cloud-image")
+	writeTestQcow2(t, image, false)
+
+	resource.UnitTest(t, resource.TestCase{
+		Providers:    testProviders(),
+		CheckDestroy: testCheckImagesDeleted,
+		Steps: []resource.TestStep{
+			{
+				Config: testImageConfig(image, `format = "qcow2"`),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("virtualbox_image.ubuntu", "format", "qcow2"),
+					resource.TestCheckResourceAttr("virtualbox_image.ubuntu", "disks.#", "1"),
+					resource.TestMatchResourceAttr("virtualbox_image.ubuntu", "disks.0", regexp.MustCompile(`cloud-image\.vdi$`)),
+					testCheckImagePath("virtualbox_image.ubuntu", func(string) error {
+						_, err := os.Stat(image)
+						return err
+					}),
+				),
+			},
+		},
+	})
+}
+
+func TestResourceImage_applianceFormat(t *testing.T) {
+	newFakeVBoxManage(t)
+	setupTestImage(t)
+	source := filepath.Join(os.Getenv("HOME"), "appliances")
+	if err := os.Mkdir(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	image := filepath.Join(source, "appliance")
+	if err := ioutil.WriteFile(image, []byte("ova"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		Providers: testProviders(),
+		CheckDestroy: resource.ComposeTestCheckFunc(
+			testCheckImagesDeleted,
+			func(*terraform.State) error {
+				_, err := os.Stat(image)
+				return err
+			},
+		),
+		Steps: []resource.TestStep{
+			{
+				Config: testImageConfig(image, `format = "ova"`),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("virtualbox_image.ubuntu", "disks.#", "0"),
+					resource.TestCheckResourceAttr("virtualbox_image.ubuntu", "size", "3"),
+					testCheckImagePath("virtualbox_image.ubuntu", func(path string) error {
+						if filepath.Ext(path) != ".ova" {
+							return fmt.Errorf("appliance %s doesn't end in .ova", path)
+						}
+						// Nothing is left next to the image of the user
+						files, err := ioutil.ReadDir(source)
+						if err != nil {
+							return err
+						}
+						if len(files) != 1 {
+							return fmt.Errorf("%d files next to the image", len(files))
+						}
+						return nil
+					}),
+				),
+			},
+		},
+	})
+}
+
+func TestResourceImage_shared(t *testing.T) {
+	newFakeVBoxManage(t)
+	image, _ := setupTestImage(t)
+	data, err := ioutil.ReadFile(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksum := fmt.Sprintf("%x", sha256.Sum256(data))
+	config := func(names ...string) string {
+		var config string
+		for _, name := range names {
+			extra := ""
+			if name == "checked" {
+				extra = fmt.Sprintf("checksum = %q\nchecksum_type = \"sha256\"", checksum)
+			}
+			config += strings.Replace(testImageConfig(image, extra), `"ubuntu"`, fmt.Sprintf("%q", name), 1)
+		}
+		return config
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		Providers:    testProviders(),
+		CheckDestroy: testCheckImagesDeleted,
+		Steps: []resource.TestStep{
+			{
+				Config: config("a", "b", "checked"),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttrPair("virtualbox_image.a", "path", "virtualbox_image.b", "path"),
+					func(s *terraform.State) error {
+						resources := s.RootModule().Resources
+						if resources["virtualbox_image.a"].Primary.ID == resources["virtualbox_image.b"].Primary.ID {
+							return fmt.Errorf("images share their ID")
+						}
+						if resources["virtualbox_image.a"].Primary.Attributes["path"] ==
+							resources["virtualbox_image.checked"].Primary.Attributes["path"] {
+							return fmt.Errorf("images of another checksum share their gold folder")
+						}
+						return nil
+					},
+				),
+			},
+			{
+				// Destroying b leaves the gold folder of a in place
+				Config: config("a"),
+				Check: testCheckImagePath("virtualbox_image.a", func(path string) error {
+					if !goldComplete(path) {
+						return fmt.Errorf("gold image %s was removed", path)
+					}
+					return nil
+				}),
+			},
+		},
+	})
+}
+
+func TestResourceImage_download(t *testing.T) {
+	newFakeVBoxManage(t)
+	image, _ := setupTestImage(t)
+	server := httptest.NewServer(http.FileServer(http.Dir(filepath.Dir(image))))
+	defer server.Close()
+	download := ""
+
+	resource.UnitTest(t, resource.TestCase{
+		Providers: testProviders(),
+		CheckDestroy: resource.ComposeTestCheckFunc(
+			testCheckImagesDeleted,
+			func(*terraform.State) error {
+				if _, err := os.Stat(download); !os.IsNotExist(err) {
+					return fmt.Errorf("download %s was not removed: %v", download, err)
+				}
+				// Other processes may wait on the lock
+				_, err := os.Stat(download + ".lock")
+				return err
+			},
+		),
+		Steps: []resource.TestStep{
+			{
+				Config: testImageConfig(server.URL+"/ubuntu.box", ""),
+				Check: func(*terraform.State) error {
+					u, err := url.Parse(server.URL + "/ubuntu.box")
+					if err != nil {
+						return err
+					}
+					if download, err = cachePath(nil, u); err != nil {
+						return err
+					}
+					_, err = os.Stat(download)
+					return err
+				},
+			},
+		},
+	})
+}
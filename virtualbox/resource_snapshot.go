@@ -0,0 +1,263 @@
+package virtualbox
+
+import (
+	"bufio"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+	"github.com/pkg/errors"
+	vbox "github.com/terra-farm/go-virtualbox"
+)
+
+func resourceSnapshot() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceSnapshotCreate,
+		Read:   resourceSnapshotRead,
+		Update: resourceSnapshotUpdate,
+		Delete: resourceSnapshotDelete,
+
+		Schema: map[string]*schema.Schema{
+
+			"vm_id": {
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+
+			"name": {
+				Type:     schema.TypeString,
+				Required: true,
+			},
+
+			"description": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "",
+			},
+
+			"live": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				ForceNew:    true,
+				Description: "Take the snapshot without pausing the running VM",
+			},
+
+			"restore_trigger": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Arbitrary value, the VM is restored to the snapshot whenever it changes",
+			},
+
+			"uuid": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			"parent": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "UUID of the parent snapshot, empty for the first snapshot of the VM",
+			},
+		},
+	}
+}
+
+// snapshot is a node of the snapshot tree of a VM.
+type snapshot struct {
+	Name        string
+	UUID        string
+	Description string
+	Parent      string
+}
+
+var (
+	// Matches the snapshot keys of 'showvminfo --machinereadable', the
+	// suffix being the path in the tree, e.g. SnapshotName-1-2
+	reSnapshotKey = regexp.MustCompile(`^Snapshot(Name|UUID|Description)((?:-\d+)*)$`)
+	// Matches the output of 'snapshot take'
+	reSnapshotTaken = regexp.MustCompile(`UUID: ([0-9a-f-]+)`)
+)
+
+// parseSnapshots extracts the snapshot tree from the machine readable
+// 'showvminfo' output, returning the snapshots by UUID.
+func parseSnapshots(out string) (map[string]snapshot, error) {
+	byPath := make(map[string]*snapshot)
+	s := bufio.NewScanner(strings.NewReader(out))
+	for s.Scan() {
+		parts := strings.SplitN(s.Text(), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		res := reSnapshotKey.FindStringSubmatch(parts[0])
+		if res == nil {
+			continue
+		}
+		value := strings.Trim(parts[1], `"`)
+		snap, ok := byPath[res[2]]
+		if !ok {
+			snap = &snapshot{}
+			byPath[res[2]] = snap
+		}
+		switch res[1] {
+		case "Name":
+			snap.Name = value
+		case "UUID":
+			snap.UUID = value
+		case "Description":
+			snap.Description = value
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	snapshots := make(map[string]snapshot, len(byPath))
+	for path, snap := range byPath {
+		if i := strings.LastIndex(path, "-"); i >= 0 {
+			if parent, ok := byPath[path[:i]]; ok {
+				snap.Parent = parent.UUID
+			}
+		}
+		snapshots[snap.UUID] = *snap
+	}
+	return snapshots, nil
+}
+
+func readSnapshots(vmID string) (map[string]snapshot, error) {
+	out, err := vboxManage("showvminfo", vmID, "--machinereadable")
+	if err != nil {
+		return nil, err
+	}
+	return parseSnapshots(out)
+}
+
+func resourceSnapshotCreate(d *schema.ResourceData, meta interface{}) error {
+	vmID := d.Get("vm_id").(string)
+	args := []string{"snapshot", vmID, "take", d.Get("name").(string)}
+	if description := d.Get("description").(string); description != "" {
+		args = append(args, "--description", description)
+	}
+	if d.Get("live").(bool) {
+		args = append(args, "--live")
+	}
+
+	out, err := vboxManage(args...)
+	if err != nil {
+		return errLogf("Taking snapshot of VM %s: %v", vmID, err)
+	}
+	res := reSnapshotTaken.FindStringSubmatch(out)
+	if res == nil {
+		return errLogf("Taking snapshot of VM %s: no UUID in output %q", vmID, out)
+	}
+
+	log.Printf("[DEBUG] Snapshot ID: %s\n", res[1])
+	d.SetId(res[1])
+
+	return resourceSnapshotRead(d, meta)
+}
+
+func resourceSnapshotRead(d *schema.ResourceData, meta interface{}) error {
+	vmID := d.Get("vm_id").(string)
+	switch _, err := vbox.GetMachine(vmID); err {
+	case nil:
+		break
+	case vbox.ErrMachineNotExist:
+		// The VM and its snapshots no longer exist.
+		d.SetId("")
+		return nil
+	default:
+		return errLogf("unable to get machine: %v", err)
+	}
+
+	snapshots, err := readSnapshots(vmID)
+	if err != nil {
+		return errLogf("unable to get snapshots of VM %s: %v", vmID, err)
+	}
+	snap, ok := snapshots[d.Id()]
+	if !ok {
+		// Snapshot no longer exists.
+		d.SetId("")
+		return nil
+	}
+
+	for key, value := range map[string]string{
+		"name":        snap.Name,
+		"description": snap.Description,
+		"uuid":        snap.UUID,
+		"parent":      snap.Parent,
+	} {
+		if err := d.Set(key, value); err != nil {
+			return errLogf("can't set %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+func resourceSnapshotUpdate(d *schema.ResourceData, meta interface{}) error {
+	vmID := d.Get("vm_id").(string)
+
+	if d.HasChanges("name", "description") {
+		if _, err := vboxManage("snapshot", vmID, "edit", d.Id(),
+			"--name", d.Get("name").(string),
+			"--description", d.Get("description").(string)); err != nil {
+			return errLogf("unable to edit snapshot %s: %v", d.Id(), err)
+		}
+	}
+
+	if d.HasChange("restore_trigger") {
+		if err := restoreSnapshot(vmID, d.Id()); err != nil {
+			return errLogf("unable to restore snapshot %s: %v", d.Id(), err)
+		}
+	}
+
+	return resourceSnapshotRead(d, meta)
+}
+
+// restoreSnapshot rolls the VM back to the snapshot. A running VM is powered
+// off for the restore and started again afterwards.
+func restoreSnapshot(vmID, snapshotID string) error {
+	vm, err := vbox.GetMachine(vmID)
+	if err != nil {
+		return errors.Wrap(err, "can't get machine")
+	}
+
+	running := vm.State == vbox.Running || vm.State == vbox.Paused
+	if running {
+		if err := vm.Poweroff(); err != nil {
+			return errors.Wrap(err, "can't power off machine")
+		}
+	}
+
+	if _, err := vboxManage("snapshot", vmID, "restore", snapshotID); err != nil {
+		return err
+	}
+
+	if !running {
+		return nil
+	}
+	if err := vm.Refresh(); err != nil {
+		return errors.Wrap(err, "can't refresh machine")
+	}
+	return errors.Wrap(vm.Start(), "can't start machine")
+}
+
+func resourceSnapshotDelete(d *schema.ResourceData, meta interface{}) error {
+	vmID := d.Get("vm_id").(string)
+	switch _, err := vbox.GetMachine(vmID); err {
+	case nil:
+		break
+	case vbox.ErrMachineNotExist:
+		// Snapshots went away with the VM.
+		return nil
+	default:
+		return errLogf("unable to get machine: %v", err)
+	}
+
+	if _, err := vboxManage("snapshot", vmID, "delete", d.Id()); err != nil {
+		return errLogf("unable to delete snapshot %s: %v", d.Id(), err)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package virtualbox
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// Excerpt of 'VBoxManage showvminfo --machinereadable' for a VM with a
+// snapshot tree: base -> (provisioned -> patched, scratch)
+const showVMInfoSnapshots = `name="node-01"
+UUID="3c4f3b7e-7c2f-4a7e-9a4e-2f0a3f6b1c11"
+SnapshotName="base"
+SnapshotUUID="0a7b8a57-3d0e-4a3f-8f6f-6d6bd6f0e001"
+SnapshotName-1="provisioned"
+SnapshotUUID-1="0a7b8a57-3d0e-4a3f-8f6f-6d6bd6f0e002"
+SnapshotDescription-1="after ansible"
+SnapshotName-1-1="patched"
+SnapshotUUID-1-1="0a7b8a57-3d0e-4a3f-8f6f-6d6bd6f0e003"
+SnapshotName-2="scratch"
+SnapshotUUID-2="0a7b8a57-3d0e-4a3f-8f6f-6d6bd6f0e004"
+CurrentSnapshotName="patched"
+CurrentSnapshotUUID="0a7b8a57-3d0e-4a3f-8f6f-6d6bd6f0e003"
+CurrentSnapshotNode="SnapshotName-1-1"
+`
+
+func TestParseSnapshots(t *testing.T) {
+	Convey("Parse the snapshot tree from showvminfo", t, func() {
+		snapshots, err := parseSnapshots(showVMInfoSnapshots)
+		So(err, ShouldBeNil)
+		So(snapshots, ShouldHaveLength, 4)
+
+		So(snapshots["0a7b8a57-3d0e-4a3f-8f6f-6d6bd6f0e001"], ShouldResemble, snapshot{
+			Name: "base", UUID: "0a7b8a57-3d0e-4a3f-8f6f-6d6bd6f0e001",
+		})
+		So(snapshots["0a7b8a57-3d0e-4a3f-8f6f-6d6bd6f0e002"], ShouldResemble, snapshot{
+			Name: "provisioned", UUID: "0a7b8a57-3d0e-4a3f-8f6f-6d6bd6f0e002",
+			Description: "after ansible", Parent: "0a7b8a57-3d0e-4a3f-8f6f-6d6bd6f0e001",
+		})
+		So(snapshots["0a7b8a57-3d0e-4a3f-8f6f-6d6bd6f0e003"].Parent, ShouldEqual, "0a7b8a57-3d0e-4a3f-8f6f-6d6bd6f0e002")
+		So(snapshots["0a7b8a57-3d0e-4a3f-8f6f-6d6bd6f0e004"].Parent, ShouldEqual, "0a7b8a57-3d0e-4a3f-8f6f-6d6bd6f0e001")
+	})
+}
@@ -1,34 +1,37 @@
 package virtualbox
 
 import (
+	"encoding/base64"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
-	"net/url"
 	"os"
 	"os/exec"
-	"os/user"
+	"path"
 	"path/filepath"
-	"runtime"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
-	humanize "github.com/dustin/go-humanize"
 	multierror "github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/terraform-plugin-sdk/helper/customdiff"
 	"github.com/hashicorp/terraform-plugin-sdk/helper/resource"
 	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/helper/validation"
 	"github.com/pkg/errors"
 	vbox "github.com/terra-farm/go-virtualbox"
 )
 
 var (
-	vbm              string // Path to VBoxManage utility.
 	defaultBootOrder = []string{"disk", "none", "none", "none"}
 )
 
+const (
+	// defaultCPUs is the number of CPUs of VMs not setting cpus.
+	defaultCPUs = 2
+	// defaultOSType is the OS type of VMs, unless their Vagrant box has one.
+	defaultOSType = "Linux_64"
+)
+
 func init() {
 	vbox.Verbose = true
 }
@@ -41,6 +44,14 @@ func resourceVM() *schema.Resource {
 		Update: resourceVMUpdate,
 		Delete: resourceVMDelete,
 
+		CustomizeDiff: customdiff.All(
+			customizeDiffNetworkAdapters,
+			customizeDiffChecksum,
+			customizeDiffSignature,
+			customizeDiffMemory,
+			customizeDiffOvercommit,
+		),
+
 		Schema: map[string]*schema.Schema{
 
 			"name": {
@@ -62,6 +73,21 @@ func resourceVM() *schema.Resource {
 				Deprecated: "Use the \"image\" option with a URL",
 			},
 
+			"hardware_source": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     true,
+				Description:  "Hardware of VMs imported from OVA/OVF images: the one declared in Terraform (default), or the appliance's",
+				ValidateFunc: validation.StringInSlice(validHardwareSources, false),
+			},
+
+			"boot_disk": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				ForceNew:    true,
+				Description: "Gold disk attached to the first SATA port, by its file name or its path in the image",
+			},
+
 			"optical_disks": {
 				Type:        schema.TypeList,
 				Optional:    true,
@@ -70,27 +96,94 @@ func resourceVM() *schema.Resource {
 			},
 
 			"cpus": {
-				Type:     schema.TypeInt,
-				Optional: true,
-				Default:  "2",
+				Type:             schema.TypeInt,
+				Optional:         true,
+				Default:          defaultCPUs,
+				DiffSuppressFunc: suppressApplianceCPUs,
 			},
 
 			"memory": {
-				Type:     schema.TypeString,
-				Optional: true,
-				Default:  "512mib",
+				Type:             schema.TypeString,
+				Optional:         true,
+				Computed:         true,
+				ValidateFunc:     validateMemory,
+				DiffSuppressFunc: suppressMemoryDiff,
+				ConflictsWith:    []string{"memory_mb"},
+			},
+
+			"memory_mb": {
+				Type:          schema.TypeInt,
+				Optional:      true,
+				Computed:      true,
+				Description:   "Memory size in MiB",
+				ValidateFunc:  validation.IntAtLeast(1),
+				ConflictsWith: []string{"memory"},
 			},
 
 			"status": {
-				Type:     schema.TypeString,
-				Optional: true,
-				Default:  "running",
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "running",
+				ValidateFunc: validation.StringInSlice(validVMStatuses, false),
 			},
 
 			"user_data": {
-				Type:     schema.TypeString,
-				Optional: true,
-				Default:  "",
+				Type:          schema.TypeString,
+				Optional:      true,
+				Default:       "",
+				Sensitive:     true,
+				StateFunc:     hashUserData,
+				ValidateFunc:  validateUserData,
+				ConflictsWith: []string{"user_data_base64"},
+			},
+
+			"user_data_base64": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				Default:       "",
+				Description:   "Base64 encoded user data, for binary or pre-compressed payloads",
+				Sensitive:     true,
+				StateFunc:     hashUserData,
+				ValidateFunc:  validateUserData,
+				ConflictsWith: []string{"user_data"},
+			},
+
+			"meta_data": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     "",
+				Description: "cloud-init NoCloud meta-data, defaults to the instance-id and hostname derived from the name",
+			},
+
+			"network_config": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     "",
+				Description: "cloud-init NoCloud network-config",
+			},
+
+			"ignition_config": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "",
+				Sensitive:    true,
+				Description:  "Ignition config (JSON) for Fedora CoreOS and Flatcar guests",
+				ValidateFunc: validateIgnitionConfig,
+			},
+
+			"extra_data": {
+				Type:         schema.TypeMap,
+				Optional:     true,
+				Description:  "VirtualBox extradata keys managed on the VM",
+				Elem:         &schema.Schema{Type: schema.TypeString},
+				ValidateFunc: validateExtraData,
+			},
+
+			"guest_properties": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Description: "Guest properties managed on the VM",
+				Elem:        &schema.Schema{Type: schema.TypeString},
 			},
 
 			"checksum": {
@@ -100,26 +193,45 @@ func resourceVM() *schema.Resource {
 			},
 
 			"checksum_type": {
-				Type:     schema.TypeString,
-				Optional: true,
-				Default:  "",
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "",
+				ValidateFunc: validation.StringInSlice(validChecksumTypes, false),
+			},
+
+			"signature_url": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				ForceNew:    true,
+				Description: "URL of the detached signature of the image, or of a checksum file listing it",
+			},
+
+			"public_key": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				ForceNew:    true,
+				Description: "Armored OpenPGP or minisign public key trusted to sign the image",
 			},
 
 			"network_adapter": {
-				Type:     schema.TypeList,
-				Optional: true,
+				Type:             schema.TypeList,
+				Optional:         true,
+				MaxItems:         maxNetworkAdapters,
+				DiffSuppressFunc: suppressApplianceNICs,
 				Elem: &schema.Resource{
 					Schema: map[string]*schema.Schema{
 
 						"type": {
-							Type:     schema.TypeString,
-							Required: true,
+							Type:         schema.TypeString,
+							Required:     true,
+							ValidateFunc: validation.StringInSlice(validNetworkTypes, false),
 						},
 
 						"device": {
-							Type:     schema.TypeString,
-							Optional: true,
-							Default:  "IntelPro1000MTServer",
+							Type:         schema.TypeString,
+							Optional:     true,
+							Default:      "IntelPro1000MTServer",
+							ValidateFunc: validation.StringInSlice(validNetworkDevices, false),
 						},
 
 						"host_interface": {
@@ -150,12 +262,59 @@ func resourceVM() *schema.Resource {
 				},
 			},
 
+			"shared_folder": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+
+						"name": {
+							Type:     schema.TypeString,
+							Required: true,
+						},
+
+						"host_path": {
+							Type:     schema.TypeString,
+							Required: true,
+						},
+
+						"auto_mount": {
+							Type:     schema.TypeBool,
+							Optional: true,
+							Default:  false,
+						},
+
+						"read_only": {
+							Type:     schema.TypeBool,
+							Optional: true,
+							Default:  false,
+						},
+
+						"mount_point": {
+							Type:     schema.TypeString,
+							Optional: true,
+							Default:  "",
+						},
+
+						"transient": {
+							Type:        schema.TypeBool,
+							Optional:    true,
+							Default:     false,
+							Description: "Share the folder only while the VM runs, changes are then applied without restarting it",
+						},
+					},
+				},
+			},
+
 			"boot_order": {
 				Type:        schema.TypeList,
 				Optional:    true,
-				Description: "Boot order, max 4 slots, each in [none, floopy, dvd, disk, net]",
-				Elem:        &schema.Schema{Type: schema.TypeString},
-				MaxItems:    4,
+				Description: "Boot order, max 4 slots, each in [none, floppy, dvd, disk, net]",
+				Elem: &schema.Schema{
+					Type:         schema.TypeString,
+					ValidateFunc: validation.StringInSlice(validBootDevices, false),
+				},
+				MaxItems: 4,
 			},
 		},
 	}
@@ -174,119 +333,209 @@ func resourceVMExists(d *schema.ResourceData, meta interface{}) (bool, error) {
 	}
 }
 
-var imageOpMutex sync.Mutex
-
 func resourceVMCreate(d *schema.ResourceData, meta interface{}) error {
-	image := d.Get("image").(string)
-
-	if addr, exists := d.GetOk("url"); exists {
-		image = addr.(string)
+	img := &image{
+		URL:          d.Get("image").(string),
+		Checksum:     d.Get("checksum").(string),
+		ChecksumType: d.Get("checksum_type").(string),
+		SignatureURL: d.Get("signature_url").(string),
+		PublicKey:    d.Get("public_key").(string),
 	}
-
-	u, err := url.Parse(image)
-	if err != nil {
-		return fmt.Errorf("[Error] Could not parse image URL: %v", err)
+	if addr, exists := d.GetOk("url"); exists {
+		img.URL = addr.(string)
 	}
+	image := img.URL
 
-	imagePath, err := fetchIfRemote(u)
+	config, _ := meta.(*providerConfig)
+	imagePath, err := fetchIfRemote(config, img)
 	if err != nil {
 		return fmt.Errorf("[ERROR] Unable to fetch remote image: %v", err)
 	}
 
 	/* Get gold folder and machine folder */
-	usr, err := user.Current()
+	home, err := os.UserHomeDir()
 	if err != nil {
-		return errLogf("Get the current user: %v", err)
+		return errLogf("Get the home directory: %v", err)
 	}
-	goldFolder := filepath.Join(usr.HomeDir, ".terraform/virtualbox/gold")
-	machineFolder := filepath.Join(usr.HomeDir, ".terraform/virtualbox/machine")
-	err = os.MkdirAll(goldFolder, 0740)
+	goldFolder, err := goldFolderPath()
 	if err != nil {
 		return fmt.Errorf("[ERROR] Unable to create gold folder: %v", err)
 	}
+	machineFolder := filepath.Join(home, ".terraform/virtualbox/machine")
 	err = os.MkdirAll(machineFolder, 0740)
 	if err != nil {
 		return fmt.Errorf("[ERROR] Unable to create machine folder: %v", err)
 	}
 
-	// Unpack gold image to gold folder
-	imageOpMutex.Lock() // Sequentialize image unpacking to avoid conflicts
-	goldFileName := filepath.Base(imagePath)
-	goldName := strings.TrimSuffix(goldFileName, filepath.Ext(goldFileName))
-	if filepath.Ext(goldName) == ".tar" {
-		goldName = strings.TrimSuffix(goldName, ".tar")
+	name := d.Get("name").(string)
+	var vm *vbox.Machine
+	if isAppliance(imagePath) {
+		// Appliances bring their own disks and hardware definition
+		vm, err = importAppliance(d, imagePath, machineFolder)
+		if err != nil {
+			return errLogf("Importing appliance %s: %v", image, err)
+		}
+		err = setupAppliance(d, vm)
+	} else {
+		var goldPath string
+		var goldDisks []string
+		goldPath, goldDisks, err = unpackGold(image, imagePath, goldFolder)
+		if err != nil {
+			return err
+		}
+		var box *vagrantBox
+		box, err = readVagrantBox(goldPath)
+		if err != nil {
+			return errLogf("Reading Vagrant box %s: %v", image, err)
+		}
+		vm, err = vbox.CreateMachine(name, machineFolder)
+		if err != nil {
+			return errLogf("Create virtualbox VM %s: %v\n", name, err)
+		}
+		err = setupVM(d, meta, vm, goldPath, goldDisks, box)
+	}
+	if err != nil {
+		// A half-created VM would block the next apply with a name conflict
+		if err := removeVM(vm); err != nil {
+			log.Printf("[WARN] Unable to clean up VM %s: %v", name, err)
+		}
+		return err
+	}
+
+	// Assign VM ID
+	log.Printf("[DEBUG] Resource ID: %s\n", vm.UUID)
+	d.SetId(vm.UUID)
+
+	sharedFolders := sharedFoldersTfToVbox(d.Get("shared_folder").([]interface{}))
+	if err := applySharedFolders(vm, nil, filterSharedFolders(sharedFolders, true)); err != nil {
+		return errLogf("Sharing transient folders: %v", err)
+	}
+
+	if err := waitUntilVMIsReady(d, vm, meta); err != nil {
+		return errLogf("Wait VM until ready: %v", err)
 	}
 
-	goldPath := filepath.Join(goldFolder, goldName)
-	if err = unpackImage(imagePath, goldPath); err != nil {
+	// Errors here are already logged.
+	return resourceVMRead(d, meta)
+}
+
+// unpackGold unpacks the gold image into the gold folder, unpacking is
+// locked per image, and returns its path and disks. Gold folders of a
+// virtualbox_image are used as they are.
+func unpackGold(image, imagePath, goldFolder string) (string, []string, error) {
+	goldPath := imagePath
+	if !goldComplete(goldPath) {
+		goldPath = filepath.Join(goldFolder, goldName(imagePath))
+	}
+	if err := unpackImage(imagePath, goldPath); err != nil {
 		log.Printf("[ERROR] Unpack image %s: %s", imagePath, err.Error())
-		imageOpMutex.Unlock()
-		return errLogf("Unpacking image %s: %v", image, err)
+		return "", nil, errLogf("Unpacking image %s: %v", image, err)
 	}
-	imageOpMutex.Unlock()
 
 	// Gather '*.vdi' and "*.vmdk" files from gold
 	goldDisks, err := gatherDisks(goldPath)
 	if err != nil {
-		return errLogf("Unable to gather disks: %v", err)
+		return "", nil, errLogf("Unable to gather disks: %v", err)
 	}
+	return goldPath, goldDisks, nil
+}
 
-	// Create VM instance
-	name := d.Get("name").(string)
-	vm, err := vbox.CreateMachine(name, machineFolder)
-	if err != nil {
-		return errLogf("Create virtualbox VM %s: %v\n", name, err)
-	}
-
-	// Clone gold virtual disk files to VM folder
-	for _, src := range goldDisks {
-		filename := filepath.Base(src)
-
-		target := filepath.Join(vm.BaseFolder, filename)
-		vbm = "VBoxManage"
-		if p := os.Getenv("VBOX_INSTALL_PATH"); p != "" && runtime.GOOS == "windows" {
-			vbm = filepath.Join(p, "VBoxManage.exe")
-		}
-		setUUIDCmd := exec.Command(vbm, "internalcommands", "sethduuid", src)
-		if err := setUUIDCmd.Run(); err != nil {
-			return errLogf("Unable to set UUID: %v", err)
+// setupVM clones the gold disks into the new VM, configures and starts it.
+// The disks and hardware follow the Vagrant box, if the image is one.
+func setupVM(
+	d *schema.ResourceData, meta interface{}, vm *vbox.Machine, goldPath string, goldDisks []string, box *vagrantBox,
+) error {
+	boot := -1
+	if name := d.Get("boot_disk").(string); name != "" {
+		var err error
+		if boot, err = findBootDisk(goldPath, goldDisks, name); err != nil {
+			return errLogf("Choosing the boot disk: %v", err)
 		}
+	}
 
-		imageOpMutex.Lock() // Sequentialize image cloning to improve disk performance
-		err := vbox.CloneHD(src, target)
-		imageOpMutex.Unlock()
-		if err != nil {
-			return errLogf("Clone *.vdi and *.vmdk to VM folder: %v", err)
-		}
+	// Clone gold virtual disk files to VM folder, keeping other processes
+	// from replacing the gold image meanwhile
+	lock, err := rlockGold(goldPath)
+	if err != nil {
+		return errLogf("Locking gold image: %v", err)
+	}
+	config, _ := meta.(*providerConfig)
+	vmDisks, err := cloneGoldDisks(config, vm, goldPath, goldDisks)
+	if uerr := lock.Unlock(); uerr != nil {
+		log.Printf("[WARN] Unable to unlock gold image %s: %v", goldPath, uerr)
+	}
+	if err != nil {
+		return err
 	}
 
 	// Attach virtual disks to VM
-	vmDisks, err := gatherDisks(vm.BaseFolder)
-	if err != nil {
-		return errLogf("Unable to gather disks: %v", err)
+	var bootDisk string
+	if boot >= 0 {
+		bootDisk = vmDisks[boot]
+	}
+	slots := layoutDisks(box, vmDisks, bootDisk)
+	sataPorts := 0
+	buses := make(map[vbox.SystemBus]bool)
+	for _, slot := range slots {
+		buses[slot.Bus] = true
+		if slot.Bus == vbox.SysBusSATA && slot.Port >= sataPorts {
+			sataPorts = slot.Port + 1
+		}
 	}
 
 	if err := vm.AddStorageCtl("SATA", vbox.StorageController{
 		SysBus:      vbox.SysBusSATA,
-		Ports:       uint(len(vmDisks)) + 1,
+		Ports:       uint(sataPorts) + 1,
 		Chipset:     vbox.CtrlIntelAHCI,
 		HostIOCache: true,
 		Bootable:    true,
 	}); err != nil {
 		return errLogf("Create VirtualBox storage controller: %v", err)
 	}
+	// The seed ISO shares the IDE controller of the box
+	if buses[vbox.SysBusIDE] {
+		if err := vm.AddStorageCtl(cloudInitStorageCtl, vbox.StorageController{
+			SysBus:   vbox.SysBusIDE,
+			Chipset:  vbox.CtrlPIIX4,
+			Bootable: true,
+		}); err != nil {
+			return errLogf("Create VirtualBox storage controller: %v", err)
+		}
+	}
+	if buses[vbox.SysBusSCSI] {
+		if err := vm.AddStorageCtl("SCSI", vbox.StorageController{
+			SysBus:      vbox.SysBusSCSI,
+			Chipset:     vbox.CtrlLSILogic,
+			HostIOCache: true,
+			Bootable:    true,
+		}); err != nil {
+			return errLogf("Create VirtualBox storage controller: %v", err)
+		}
+	}
 
-	for i, disk := range vmDisks {
-		if err := vm.AttachStorage("SATA", vbox.StorageMedium{
-			Port:      uint(i),
-			Device:    0,
+	for _, slot := range slots {
+		ctl := "SATA"
+		switch slot.Bus {
+		case vbox.SysBusIDE:
+			ctl = cloudInitStorageCtl
+		case vbox.SysBusSCSI:
+			ctl = "SCSI"
+		}
+		if err := vm.AttachStorage(ctl, vbox.StorageMedium{
+			Port:      uint(slot.Port),
+			Device:    uint(slot.Device),
 			DriveType: vbox.DriveHDD,
-			Medium:    disk,
+			Medium:    slot.File,
 		}); err != nil {
 			return errLogf("Attaching VirtualBox storage medium: %v", err)
 		}
 	}
+	return configureVM(d, vm, box, "SATA", sataPorts)
+}
 
+// configureVM attaches the optical disks to the storage controller opticalCtl
+// from port opticalPort on, configures the VM and starts it.
+func configureVM(d *schema.ResourceData, vm *vbox.Machine, box *vagrantBox, opticalCtl string, opticalPort int) error {
 	opticalDiskCount := d.Get("optical_disks.#").(int)
 	opticalDisks := make([]string, 0, opticalDiskCount)
 
@@ -308,8 +557,8 @@ func resourceVMCreate(d *schema.ResourceData, meta interface{}) error {
 			return errLogf("Cloning *.iso and *.dmg to VM folder: %v", err)
 		}
 
-		if err := vm.AttachStorage("SATA", vbox.StorageMedium{
-			Port:      uint(len(vmDisks) + i),
+		if err := vm.AttachStorage(opticalCtl, vbox.StorageMedium{
+			Port:      uint(opticalPort + i),
 			Device:    0,
 			DriveType: vbox.DriveDVD,
 			Medium:    target,
@@ -319,28 +568,59 @@ func resourceVMCreate(d *schema.ResourceData, meta interface{}) error {
 	}
 
 	// Setup VM general properties
-	if err := tfToVbox(d, vm); err != nil {
-		return errLogf("Converting Terraform data to VM properties: %v", err)
+	if keepsApplianceHardware(d.Get) {
+		if err := modifyApplianceVM(d, vm); err != nil {
+			return errLogf("Setup VM properties: %v", err)
+		}
+	} else {
+		if err := tfToVbox(d, vm); err != nil {
+			return errLogf("Converting Terraform data to VM properties: %v", err)
+		}
+		if box != nil && box.OSType != "" {
+			vm.OSType = box.OSType
+		}
+		if err := vm.Modify(); err != nil {
+			return errLogf("Setup VM properties: %v", err)
+		}
+		if err := disableNICs(vm, d.Get("network_adapter.#").(int)); err != nil {
+			return errLogf("Setup VM network adapters: %v", err)
+		}
+		if err := applyBoxHardware(vm, box); err != nil {
+			return errLogf("Setup VM properties of the Vagrant box: %v", err)
+		}
 	}
-	if err := vm.Modify(); err != nil {
-		return errLogf("Setup VM properties: %v", err)
+
+	// Attach the cloud-init NoCloud seed
+	if err := attachCloudInitSeed(d, vm); err != nil {
+		return errLogf("Attaching cloud-init seed: %v", err)
 	}
 
-	// Start the VM
-	if err := vm.Start(); err != nil {
-		return errLogf("Starting VM: %v", err)
+	// Set extradata and guest properties
+	if err := applyExtraData(vm, nil, d.Get("extra_data").(map[string]interface{})); err != nil {
+		return errLogf("Setting extradata: %v", err)
+	}
+	if err := applyGuestProperties(vm, nil, d.Get("guest_properties").(map[string]interface{})); err != nil {
+		return errLogf("Setting guest properties: %v", err)
 	}
 
-	// Assign VM ID
-	log.Printf("[DEBUG] Resource ID: %s\n", vm.UUID)
-	d.SetId(vm.UUID)
+	// Hand the Ignition config over to the guest
+	if ignitionConfig := d.Get("ignition_config").(string); ignitionConfig != "" {
+		if err := setIgnitionConfig(vm, ignitionConfig); err != nil {
+			return errLogf("Setting Ignition config: %v", err)
+		}
+	}
 
-	if err := waitUntilVMIsReady(d, vm, meta); err != nil {
-		return errLogf("Wait VM until ready: %v", err)
+	// Share permanent folders, transient ones need a running VM
+	sharedFolders := sharedFoldersTfToVbox(d.Get("shared_folder").([]interface{}))
+	if err := applySharedFolders(vm, nil, filterSharedFolders(sharedFolders, false)); err != nil {
+		return errLogf("Sharing folders: %v", err)
 	}
 
-	// Errors here are already logged.
-	return resourceVMRead(d, meta)
+	// Start the VM
+	if err := vm.Start(); err != nil {
+		return errLogf("Starting VM: %v", err)
+	}
+	return nil
 }
 
 func setState(d *schema.ResourceData, state vbox.MachineState) error {
@@ -363,6 +643,32 @@ func setState(d *schema.ResourceData, state vbox.MachineState) error {
 	return nil
 }
 
+// machineVboxToTf sets the general VM attributes, shared by the
+// virtualbox_vm resource and data source.
+func machineVboxToTf(vm *vbox.Machine, d *schema.ResourceData) error {
+	err := setState(d, vm.State)
+	if err != nil {
+		return errLogf("can't set state: %v", err)
+	}
+	err = d.Set("name", vm.Name)
+	if err != nil {
+		return errLogf("can't set name: %v", err)
+	}
+	err = d.Set("cpus", vm.CPUs)
+	if err != nil {
+		return errLogf("can't set cpus: %v", err)
+	}
+	err = d.Set("memory", formatMemory(vm.Memory))
+	if err != nil {
+		return errLogf("can't set memory: %v", err)
+	}
+	err = d.Set("memory_mb", int(vm.Memory))
+	if err != nil {
+		return errLogf("can't set memory_mb: %v", err)
+	}
+	return nil
+}
+
 func resourceVMRead(d *schema.ResourceData, meta interface{}) error {
 	vm, err := vbox.GetMachine(d.Id())
 	switch err {
@@ -381,23 +687,8 @@ func resourceVMRead(d *schema.ResourceData, meta interface{}) error {
 	// 	return nil
 	// }
 
-	err = setState(d, vm.State)
-	if err != nil {
-		return errLogf("can't set state: %v", err)
-	}
-	err = d.Set("name", vm.Name)
-	if err != nil {
-		return errLogf("can't set name: %v", err)
-	}
-	err = d.Set("cpus", vm.CPUs)
-	if err != nil {
-		return errLogf("can't set cpus: %v", err)
-	}
-	bytes := uint64(vm.Memory) * humanize.MiByte
-	repr := humanize.IBytes(bytes)
-	err = d.Set("memory", strings.ToLower(repr))
-	if err != nil {
-		return errLogf("can't set memory: %v", err)
+	if err = machineVboxToTf(vm, d); err != nil {
+		return err
 	}
 
 	userData, err := vm.GetExtraData("user_data")
@@ -405,12 +696,46 @@ func resourceVMRead(d *schema.ResourceData, meta interface{}) error {
 		return errLogf("can't get user data: %v", err)
 	}
 	if userData != nil && *userData != "" {
-		err = d.Set("user_data", *userData)
+		payload, err := decodeExtraData(*userData)
+		if err != nil {
+			return errLogf("can't decode user data: %v", err)
+		}
+		// Only digests of the user data are kept in the state
+		if _, ok := d.GetOk("user_data_base64"); ok {
+			err = d.Set("user_data_base64", hashUserData(base64.StdEncoding.EncodeToString(payload)))
+		} else {
+			err = d.Set("user_data", hashUserData(string(payload)))
+		}
 		if err != nil {
 			return errLogf("can't set user_data: %v", err)
 		}
 	}
 
+	extraData, err := readExtraData(vm, sortedKeys(d.Get("extra_data").(map[string]interface{})))
+	if err != nil {
+		return errLogf("can't get extradata: %v", err)
+	}
+	if err = d.Set("extra_data", extraData); err != nil {
+		return errLogf("can't set extra_data: %v", err)
+	}
+
+	guestProperties, err := readGuestProperties(vm, sortedKeys(d.Get("guest_properties").(map[string]interface{})))
+	if err != nil {
+		return errLogf("can't get guest properties: %v", err)
+	}
+	if err = d.Set("guest_properties", guestProperties); err != nil {
+		return errLogf("can't set guest_properties: %v", err)
+	}
+
+	sharedFolders, err := readSharedFolders(vm)
+	if err != nil {
+		return errLogf("can't get shared folders: %v", err)
+	}
+	configured := sharedFoldersTfToVbox(d.Get("shared_folder").([]interface{}))
+	if err = d.Set("shared_folder", sharedFoldersVboxToTf(sharedFolders, configured)); err != nil {
+		return errLogf("can't set shared_folder: %v", err)
+	}
+
 	if err = netVboxToTf(vm, d); err != nil {
 		return errLogf("can't convert vbox network to terraform data: %v", err)
 	}
@@ -452,34 +777,252 @@ func powerOnAndWait(d *schema.ResourceData, vm *vbox.Machine, meta interface{})
 	return errors.Wrap(waitUntilVMIsReady(d, vm, meta), "unable to power on and wait")
 }
 
-func resourceVMUpdate(d *schema.ResourceData, meta interface{}) error {
-	// TODO: allow partial updates
+// Changes to these attributes are applied without restarting the VM.
+var vmLiveAttributes = map[string]bool{
+	"extra_data":       true,
+	"guest_properties": true,
+	"shared_folder":    true,
+}
 
+// vmNeedsRestart tells whether the VM must be powered off to apply the
+// changes. Changes to permanent shared folders need it, transient ones not.
+func vmNeedsRestart(d *schema.ResourceData) bool {
+	for key, s := range resourceVM().Schema {
+		if vmLiveAttributes[key] || !s.Optional && !s.Required {
+			continue
+		}
+		if d.HasChange(key) {
+			return true
+		}
+	}
+	o, n := d.GetChange("shared_folder")
+	return !sharedFoldersEqual(
+		filterSharedFolders(sharedFoldersTfToVbox(o.([]interface{})), false),
+		filterSharedFolders(sharedFoldersTfToVbox(n.([]interface{})), false))
+}
+
+func resourceVMUpdate(d *schema.ResourceData, meta interface{}) error {
 	vm, err := vbox.GetMachine(d.Id())
 	if err != nil {
 		return errLogf("unable to get machine: %v", d.Id(), err)
 	}
 
-	if err := vm.Poweroff(); err != nil {
-		return errLogf("unable to poweroff machine: %v", d.Id(), err)
+	o, n := d.GetChange("shared_folder")
+	oldFolders := sharedFoldersTfToVbox(o.([]interface{}))
+	newFolders := sharedFoldersTfToVbox(n.([]interface{}))
+	restart := vmNeedsRestart(d)
+
+	if restart {
+		if err := vm.Poweroff(); err != nil {
+			return errLogf("unable to poweroff machine: %v", d.Id(), err)
+		}
+
+		// Modify VM
+		if keepsApplianceHardware(d.Get) {
+			if err := modifyApplianceVM(d, vm); err != nil {
+				return errLogf("unable to modify the vm: %v", err)
+			}
+		} else {
+			// Keep the OS type and firmware, which may come from a Vagrant box
+			kept, err := keptHardware(vm)
+			if err != nil {
+				return errLogf("unable to get the vm hardware: %v", err)
+			}
+			if err := tfToVbox(d, vm); err != nil {
+				return errLogf("can't convert terraform config to virtual machine: %v", err)
+			}
+			if kept.OSType != "" {
+				vm.OSType = kept.OSType
+			}
+			if err := vm.Modify(); err != nil {
+				return errLogf("unable to modify the vm: %v", err)
+			}
+			if d.HasChange("network_adapter") {
+				if err := disableNICs(vm, d.Get("network_adapter.#").(int)); err != nil {
+					return errLogf("unable to remove network adapters: %v", err)
+				}
+			}
+			if err := applyBoxHardware(vm, kept); err != nil {
+				return errLogf("unable to restore the vm firmware: %v", err)
+			}
+		}
+
+		if d.HasChanges("user_data", "user_data_base64", "meta_data", "network_config") {
+			if err := attachCloudInitSeed(d, vm); err != nil {
+				return errLogf("unable to update the cloud-init seed: %v", err)
+			}
+		}
+
+		if d.HasChange("ignition_config") {
+			if err := setIgnitionConfig(vm, d.Get("ignition_config").(string)); err != nil {
+				return errLogf("unable to update the Ignition config: %v", err)
+			}
+		}
+
+		if err := applySharedFolders(vm,
+			filterSharedFolders(oldFolders, false), filterSharedFolders(newFolders, false)); err != nil {
+			return errLogf("unable to update shared folders: %v", err)
+		}
+	}
+
+	if d.HasChange("extra_data") {
+		o, n := d.GetChange("extra_data")
+		if err := applyExtraData(vm, o.(map[string]interface{}), n.(map[string]interface{})); err != nil {
+			return errLogf("unable to update extradata: %v", err)
+		}
 	}
 
-	// Modify VM
-	if err := tfToVbox(d, vm); err != nil {
-		return errLogf("can't convert terraform config to virtual machine: %v", err)
+	if d.HasChange("guest_properties") {
+		o, n := d.GetChange("guest_properties")
+		if err := applyGuestProperties(vm, o.(map[string]interface{}), n.(map[string]interface{})); err != nil {
+			return errLogf("unable to update guest properties: %v", err)
+		}
 	}
-	if err := vm.Modify(); err != nil {
-		return errLogf("unable to modify the vm: %v", err)
+
+	running := vm.State == vbox.Running
+	if restart {
+		if err := powerOnAndWait(d, vm, meta); err != nil {
+			return errLogf("unable to power on and wait for VM: %v", err)
+		}
+		// Transient folders went away with the power off
+		oldFolders = nil
+		running = true
 	}
 
-	if err := powerOnAndWait(d, vm, meta); err != nil {
-		return errLogf("unable to power on and wait for VM: %v", err)
+	if running {
+		if err := applySharedFolders(vm,
+			filterSharedFolders(oldFolders, true), filterSharedFolders(newFolders, true)); err != nil {
+			return errLogf("unable to update transient shared folders: %v", err)
+		}
+	} else {
+		log.Printf("[WARN] VM %s is not running, transient shared folders are not updated", d.Id())
 	}
 
 	// Errors are already logged
 	return resourceVMRead(d, meta)
 }
 
+// cloneGoldDisks clones the gold disks into the VM folder, within the
+// max_parallel_clones of the provider, and returns the clones in the same
+// order. The gold disks are only read, see cloneGoldDisk.
+func cloneGoldDisks(config *providerConfig, vm *vbox.Machine, goldPath string, goldDisks []string) ([]string, error) {
+	clones := make([]string, 0, len(goldDisks))
+	taken := make(map[string]bool)
+	for _, src := range goldDisks {
+		// Disks of subdirectories sharing a name are told apart by their path
+		filename := filepath.Base(src)
+		if taken[filename] {
+			rel, err := filepath.Rel(goldPath, src)
+			if err != nil {
+				return nil, err
+			}
+			filename = strings.Replace(rel, string(filepath.Separator), "_", -1)
+		}
+		taken[filename] = true
+
+		target := filepath.Join(vm.BaseFolder, filename)
+		release := config.acquireClone() // Bound parallel clones to improve disk performance
+		err := cloneGoldDisk(src, target)
+		release()
+		if err != nil {
+			return nil, errLogf("Clone *.vdi and *.vmdk to VM folder: %v", err)
+		}
+		clones = append(clones, target)
+	}
+	return clones, nil
+}
+
+// cloneGoldDisk clones the gold disk at src to target. VirtualBox only opens
+// disks under the UUID written in them, so gold disks sharing a UUID, like
+// the same box unpacked twice, conflict while both are open, and a gold disk
+// closed by one VM could be open for the clone of another. Rather than
+// opening the gold disk, it is copied next to the target and given a UUID of
+// its own, and that copy is cloned and closed.
+func cloneGoldDisk(src, target string) error {
+	copied := filepath.Join(filepath.Dir(target), "gold-"+filepath.Base(target))
+	if err := copyFile(src, copied); err != nil {
+		return errors.Wrap(err, "can't copy gold disk")
+	}
+	defer os.Remove(copied)
+	if _, err := vboxManage("internalcommands", "sethduuid", copied); err != nil {
+		return err
+	}
+	err := vbox.CloneHD(copied, target)
+	if _, cerr := vboxManage("closemedium", "disk", copied); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// findBootDisk returns the index of the gold disk named bootDisk, either by
+// its path relative to the gold image or by its file name.
+func findBootDisk(goldPath string, goldDisks []string, bootDisk string) (int, error) {
+	names := make([]string, len(goldDisks))
+	for i, disk := range goldDisks {
+		rel, err := filepath.Rel(goldPath, disk)
+		if err != nil {
+			return -1, err
+		}
+		names[i] = filepath.ToSlash(rel)
+	}
+
+	want := path.Clean(filepath.ToSlash(bootDisk))
+	var matches []int
+	for i, name := range names {
+		if name == want {
+			return i, nil
+		}
+		if path.Base(name) == want {
+			matches = append(matches, i)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return -1, fmt.Errorf("boot_disk %q is not a disk of the image: %s", bootDisk, strings.Join(names, ", "))
+	case 1:
+		return matches[0], nil
+	default:
+		return -1, fmt.Errorf("boot_disk %q matches several disks of the image, set its path: %s",
+			bootDisk, strings.Join(names, ", "))
+	}
+}
+
+// removeVM unregisters a VM and deletes its files, on a best-effort basis:
+// it carries on after errors and returns the first one.
+func removeVM(vm *vbox.Machine) error {
+	media, err := filepath.Glob(filepath.Join(vm.BaseFolder, "*"))
+	if err != nil {
+		return err
+	}
+	var firstErr error
+	if _, err := vboxManage("unregistervm", vm.UUID, "--delete"); err != nil {
+		firstErr = err
+	}
+	// Media left behind, like the clones not attached yet, stay in the
+	// media registry until they are closed
+	for _, path := range media {
+		var kind string
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".vdi", ".vmdk":
+			kind = "disk"
+		case ".iso", ".dmg":
+			kind = "dvd"
+		default:
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if _, err := vboxManage("closemedium", kind, path); err != nil {
+			log.Printf("[DEBUG] Unable to close medium %s: %v", path, err)
+		}
+	}
+	if err := os.RemoveAll(vm.BaseFolder); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
 func resourceVMDelete(d *schema.ResourceData, meta interface{}) error {
 	vm, err := vbox.GetMachine(d.Id())
 	if err != nil {
@@ -512,27 +1055,73 @@ func waitUntilVMIsReady(d *schema.ResourceData, vm *vbox.Machine, meta interface
 func tfToVbox(d *schema.ResourceData, vm *vbox.Machine) error {
 	var err error
 
-	vm.OSType = "Linux_64"
+	vm.OSType = defaultOSType
 	vm.CPUs = uint(d.Get("cpus").(int))
-	bytes, err := humanize.ParseBytes(d.Get("memory").(string))
+	vm.Memory, err = memoryMiB(d) // VirtualBox expect memory to be in MiB units
 	if err != nil {
 		return errors.Wrap(err, "cannot humanize bytes")
 	}
-	vm.Memory = uint(bytes / humanize.MiByte) // VirtualBox expect memory to be in MiB units
 
 	vm.VRAM = 20 // Always 10MiB for vram
 	vm.Flag = vbox.ACPI | vbox.IOAPIC | vbox.RTCUSEUTC | vbox.PAE |
 		vbox.HWVIRTEX | vbox.NESTEDPAGING | vbox.LARGEPAGES | vbox.LONGMODE |
 		vbox.VTXVPID | vbox.VTXUX
 	vm.NICs, err = netTfToVbox(d)
-	userData := d.Get("user_data").(string)
-	if userData != "" {
-		err = vm.SetExtraData("user_data", userData)
+	if err != nil {
+		return err
+	}
+	if err := applyUserData(d, vm); err != nil {
+		return err
+	}
+	vm.BootOrder = bootOrderTfToVbox(d.Get("boot_order").([]interface{}))
+	return nil
+}
+
+// bootOrderTfToVbox fills the four boot slots, starting from the default
+// boot order.
+func bootOrderTfToVbox(bootOrder []interface{}) []string {
+	slots := append([]string(nil), defaultBootOrder...)
+	for i, bootDev := range bootOrder {
+		slots[i] = bootDev.(string)
+	}
+	return slots
+}
+
+// applyUserData stores the user data in the VM extradata, when it changes.
+func applyUserData(d *schema.ResourceData, vm *vbox.Machine) error {
+	if !d.HasChanges("user_data", "user_data_base64") {
+		return nil
+	}
+	userData, err := userDataPayload(d, vm)
+	if err != nil {
+		return err
+	}
+	if len(userData) > 0 {
+		value, err := encodeExtraData(userData)
+		if err != nil {
+			return errors.Wrap(err, "can't encode user data")
+		}
+		err = vm.SetExtraData("user_data", value)
+		if err != nil {
+			return errors.Wrap(err, "can't set user data")
+		}
+	} else if err := vm.DeleteExtraData("user_data"); err != nil {
+		return errors.Wrap(err, "can't delete user data")
+	}
+	return nil
+}
+
+// disableNICs disables the network adapters of the VM past the first n,
+// which vm.Modify leaves as they are.
+func disableNICs(vm *vbox.Machine, n int) error {
+	if n >= maxNetworkAdapters {
+		return nil
 	}
-	vm.BootOrder = defaultBootOrder
-	for i, bootDev := range d.Get("boot_order").([]interface{}) {
-		vm.BootOrder[i] = bootDev.(string)
+	args := []string{"modifyvm", vm.UUID}
+	for i := n + 1; i <= maxNetworkAdapters; i++ {
+		args = append(args, fmt.Sprintf("--nic%d", i), "none")
 	}
+	_, err := vboxManage(args...)
 	return err
 }
 
@@ -845,46 +1434,3 @@ func newVMStateRefreshFunc(
 		return nil, "", nil
 	}
 }
-
-func fetchIfRemote(u *url.URL) (string, error) {
-	// If the schema is empty, treat it as a local path, otherwise
-	// use it as a remote.
-	if u.Scheme == "" {
-		return u.Path, nil
-	}
-
-	// TODO: Add special handing for other schemes, such as
-	// 		 s3, gcs, (s)ftp(s).
-	// We want to quit if the scheme is not currently supported.
-	switch u.Scheme {
-	case "http", "https":
-		break
-	default:
-		return "", fmt.Errorf("unsupported scheme %s", u.Scheme)
-	}
-
-	_, file := filepath.Split(u.Path)
-
-	// if the file is not found, and the error is unexpected, return
-	if _, err := os.Stat(file); err != nil && !os.IsNotExist(err) {
-		return "", err
-	}
-
-	f, err := os.Create(file)
-	if err != nil {
-		return "", err
-	}
-	defer f.Close()
-
-	resp, err := http.Get(u.String())
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	if _, err := io.Copy(f, resp.Body); err != nil {
-		return "", err
-	}
-
-	return file, nil
-}
@@ -2,3 +2,519 @@
 // License, v. 2.0. If a copy of the MPL was not distributed with this
 // file, You can obtain one at http://mozilla.org/MPL/2.0/.
 package virtualbox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/resource"
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/terraform"
+	. "github.com/smartystreets/goconvey/convey"
+	vbox "github.com/terra-farm/go-virtualbox"
+)
+
+const testVMUUID = "0b3a5bd2-2d0e-4d5a-a3b5-6f5e2d1c1f11"
+
+// fakeVMInfo returns the 'showvminfo --machinereadable' output of a VM
+// stored in baseFolder. Extra lines, like the NICs, come last and override
+// the defaults.
+func fakeVMInfo(name, baseFolder, state string, extra ...string) string {
+	info := fmt.Sprintf("name=%q\nUUID=%q\nCfgFile=%q\nmemory=512\ncpus=2\nvram=20\nVMState=%q\n",
+		name, testVMUUID, filepath.Join(baseFolder, name+".vbox"), state)
+	for _, line := range extra {
+		info += line + "\n"
+	}
+	return info
+}
+
+// setupTestImage makes $HOME a temporary directory and writes a gold image
+// with a single disk into it, along with the given files. It returns the
+// image and the folder of the node-01 VM.
+func setupTestImage(t *testing.T, files ...string) (string, string) {
+	home, err := ioutil.TempDir("", "tfvbox-home-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldHome := os.Getenv("HOME")
+	os.Setenv("HOME", home)
+	t.Cleanup(func() {
+		os.Setenv("HOME", oldHome)
+		os.RemoveAll(home)
+	})
+
+	box := filepath.Join(home, "box")
+	if err := os.Mkdir(box, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(box, "box-disk001.vmdk"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(box, filepath.Base(file)), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	image := filepath.Join(home, "ubuntu.box")
+	if out, err := exec.Command("tar", "-czf", image, "-C", box, ".").CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	return image, filepath.Join(home, ".terraform", "virtualbox", "machine", "node-01")
+}
+
+func TestResourceVMCreateRollback(t *testing.T) {
+	for _, step := range []string{"clonehd", "storagectl", "storageattach", "modifyvm", "startvm"} {
+		Convey(fmt.Sprintf("Remove the VM when %s fails", step), t, func() {
+			fake := newFakeVBoxManage(t)
+			image, baseFolder := setupTestImage(t)
+			disk := filepath.Join(baseFolder, "box-disk001.vmdk")
+			fake.script(t,
+				fakeCommand{Args: []string{step}, Stderr: "VBoxManage: error: failed", ExitCode: 1},
+				fakeCommand{Args: []string{"createvm"}, Create: []string{filepath.Join(baseFolder, "node-01.vbox")}},
+				fakeCommand{Args: []string{"showvminfo", "node-01"}, Stdout: fakeVMInfo("node-01", baseFolder, "poweroff")},
+				fakeCommand{Args: []string{"clonehd"}, Create: []string{disk}},
+			)
+
+			d := schema.TestResourceDataRaw(t, resourceVM().Schema, map[string]interface{}{
+				"name": "node-01", "image": image,
+			})
+			So(resourceVMCreate(d, nil), ShouldNotBeNil)
+			So(d.Id(), ShouldEqual, "")
+
+			calls := fake.calls(t)
+			So(calls, ShouldContain, "unregistervm "+testVMUUID+" --delete")
+			if step != "clonehd" {
+				So(calls, ShouldContain, "closemedium disk "+disk)
+			}
+			_, err := os.Stat(baseFolder)
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+	}
+
+	Convey("Remove the VM when import fails", t, func() {
+		fake := newFakeVBoxManage(t)
+		_, baseFolder := setupTestImage(t)
+		image := filepath.Join(os.Getenv("HOME"), "ubuntu.ova")
+		So(ioutil.WriteFile(image, nil, 0644), ShouldBeNil)
+		fake.script(t,
+			// The VM is registered before the import fails
+			fakeCommand{Args: []string{"import"}, Create: []string{filepath.Join(baseFolder, "node-01.vbox")},
+				SetState: "poweroff", Stderr: "VBoxManage: error: failed", ExitCode: 1},
+			fakeCommand{Args: []string{"showvminfo", "node-01"}, State: "poweroff", Stdout: fakeVMInfo("node-01", baseFolder, "poweroff")},
+			fakeCommand{Args: []string{"showvminfo"}, Stderr: "VBoxManage: error: Could not find a registered machine named 'node-01'", ExitCode: 1},
+		)
+
+		d := schema.TestResourceDataRaw(t, resourceVM().Schema, map[string]interface{}{
+			"name": "node-01", "image": image,
+		})
+		So(resourceVMCreate(d, nil), ShouldNotBeNil)
+		So(d.Id(), ShouldEqual, "")
+		So(fake.calls(t), ShouldContain, "unregistervm "+testVMUUID+" --delete")
+		_, err := os.Stat(baseFolder)
+		So(os.IsNotExist(err), ShouldBeTrue)
+	})
+
+	Convey("Leave a VM of the same name alone when import fails", t, func() {
+		fake := newFakeVBoxManage(t)
+		_, baseFolder := setupTestImage(t)
+		image := filepath.Join(os.Getenv("HOME"), "ubuntu.ova")
+		So(ioutil.WriteFile(image, nil, 0644), ShouldBeNil)
+		fake.script(t,
+			fakeCommand{Args: []string{"import"}, Stderr: "VBoxManage: error: failed", ExitCode: 1},
+			fakeCommand{Args: []string{"showvminfo", "node-01"}, Stdout: fakeVMInfo("node-01", baseFolder, "poweroff")},
+		)
+
+		d := schema.TestResourceDataRaw(t, resourceVM().Schema, map[string]interface{}{
+			"name": "node-01", "image": image,
+		})
+		err := resourceVMCreate(d, nil)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "already exists")
+		So(testCheckFakeNotCalled(t, fake, "import")(nil), ShouldBeNil)
+		So(testCheckFakeNotCalled(t, fake, "unregistervm")(nil), ShouldBeNil)
+	})
+}
+
+// fakeVMLifecycle scripts the node-01 VM stored in baseFolder through its
+// creation, power changes and deletion, with the fake state following its
+// power state. info are extra showvminfo lines and guestInfo the guest
+// properties reported by the guest additions.
+// The last command reports the VM as missing in any other state.
+func fakeVMLifecycle(baseFolder string, info []string, guestInfo map[string]string) []fakeCommand {
+	commands := []fakeCommand{
+		{Args: []string{"createvm"}, Create: []string{filepath.Join(baseFolder, "node-01.vbox")}, SetState: "poweroff"},
+		{Args: []string{"clonehd"}, Create: []string{filepath.Join(baseFolder, "box-disk001.vmdk")}},
+		{Args: []string{"startvm"}, SetState: "running"},
+		{Args: []string{"controlvm", "*", "poweroff"}, SetState: "poweroff"},
+		{Args: []string{"unregistervm"}, SetState: "deleted"},
+	}
+	for key, value := range guestInfo {
+		commands = append(commands, fakeCommand{
+			Args: []string{"guestproperty", "get", "*", key}, Stdout: "Value: " + value + "\n",
+		})
+	}
+	return append(commands,
+		fakeCommand{Args: []string{"showvminfo"}, State: "poweroff", Stdout: fakeVMInfo("node-01", baseFolder, "poweroff", info...)},
+		fakeCommand{Args: []string{"showvminfo"}, State: "running", Stdout: fakeVMInfo("node-01", baseFolder, "running", info...)},
+		fakeCommand{Args: []string{"showvminfo"}, Stderr: "VBoxManage: error: Could not find a registered machine named 'node-01'", ExitCode: 1},
+	)
+}
+
+// natVMInfo describes a VM with a single NAT adapter.
+var (
+	natVMInfo      = []string{`nic1="nat"`, `nictype1="82545EM"`, `macaddress1="080027000001"`}
+	natVMGuestInfo = map[string]string{
+		"/VirtualBox/GuestInfo/Net/Count":    "1",
+		"/VirtualBox/GuestInfo/Net/0/MAC":    "080027000001",
+		"/VirtualBox/GuestInfo/Net/0/Status": "Up",
+		"/VirtualBox/GuestInfo/Net/0/V4/IP":  "10.0.2.15",
+	}
+)
+
+func testProviders() map[string]terraform.ResourceProvider {
+	return map[string]terraform.ResourceProvider{"virtualbox": Provider()}
+}
+
+func testVMConfig(image, extra string) string {
+	return fmt.Sprintf(`
+resource "virtualbox_vm" "node" {
+  name  = "node-01"
+  image = %q
+
+  network_adapter {
+    type = "nat"
+  }
+  %s
+}
+`, image, extra)
+}
+
+// testCheckFakeCalled checks that the fake VBoxManage was invoked with
+// arguments containing each of the fragments.
+func testCheckFakeCalled(t *testing.T, fake *fakeVBoxManage, fragments ...string) resource.TestCheckFunc {
+	return func(*terraform.State) error {
+		calls := fake.calls(t)
+		for _, fragment := range fragments {
+			found := false
+			for _, call := range calls {
+				if strings.Contains(call, fragment) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("VBoxManage was not called with %q, calls:\n%s", fragment, strings.Join(calls, "\n"))
+			}
+		}
+		return nil
+	}
+}
+
+// testCheckFakeNotCalled checks that no invocation of the fake VBoxManage
+// contains the fragment.
+func testCheckFakeNotCalled(t *testing.T, fake *fakeVBoxManage, fragment string) resource.TestCheckFunc {
+	return func(*terraform.State) error {
+		for _, call := range fake.calls(t) {
+			if strings.Contains(call, fragment) {
+				return fmt.Errorf("VBoxManage was called with %q: %s", fragment, call)
+			}
+		}
+		return nil
+	}
+}
+
+func testCheckFakeDeleted(t *testing.T, fake *fakeVBoxManage) resource.TestCheckFunc {
+	return func(*terraform.State) error {
+		if state := fake.state(t); !strings.HasPrefix(state, "deleted") {
+			return fmt.Errorf("VM is %s, expected deleted", state)
+		}
+		return nil
+	}
+}
+
+func TestResourceVM_basic(t *testing.T) {
+	fake := newFakeVBoxManage(t)
+	image, baseFolder := setupTestImage(t)
+	fake.script(t, fakeVMLifecycle(baseFolder, natVMInfo, natVMGuestInfo)...)
+
+	resource.UnitTest(t, resource.TestCase{
+		Providers:    testProviders(),
+		CheckDestroy: testCheckFakeDeleted(t, fake),
+		Steps: []resource.TestStep{
+			{
+				Config: testVMConfig(image, ""),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("virtualbox_vm.node", "id", testVMUUID),
+					resource.TestCheckResourceAttr("virtualbox_vm.node", "status", "running"),
+					resource.TestCheckResourceAttr("virtualbox_vm.node", "cpus", "2"),
+					resource.TestCheckResourceAttr("virtualbox_vm.node", "memory", "512 mib"),
+					resource.TestCheckResourceAttr("virtualbox_vm.node", "memory_mb", "512"),
+					resource.TestCheckResourceAttr("virtualbox_vm.node", "network_adapter.0.ipv4_address", "10.0.2.15"),
+					testCheckFakeCalled(t, fake,
+						"createvm --name node-01 --register --basefolder "+filepath.Dir(baseFolder),
+						"clonehd ", "storageattach node-01 --storagectl SATA --port 0",
+						"modifyvm node-01", "startvm node-01 --type headless"),
+					// The gold disk is left untouched, a copy of it is cloned
+					testCheckFakeNotCalled(t, fake, filepath.Join(filepath.Dir(filepath.Dir(baseFolder)), "gold")),
+					testCheckFakeCalled(t, fake,
+						"sethduuid "+filepath.Join(baseFolder, "gold-box-disk001.vmdk"),
+						"closemedium disk "+filepath.Join(baseFolder, "gold-box-disk001.vmdk")),
+				),
+			},
+		},
+	})
+}
+
+func TestCloneGoldDisks(t *testing.T) {
+	Convey("Clone gold images sharing a disk UUID in parallel", t, func() {
+		fake := newFakeVBoxManage(t)
+		fake.script(t, fakeCommand{Args: []string{"clonehd"}, CreateArgs: []int{2}})
+		home := tempDir(t)
+		// The same box unpacked twice has disks of the same UUID
+		var golds []string
+		for _, name := range []string{"ubuntu", "ubuntu-copy"} {
+			gold := filepath.Join(home, "gold", name)
+			So(os.MkdirAll(gold, 0755), ShouldBeNil)
+			So(ioutil.WriteFile(filepath.Join(gold, "box-disk001.vmdk"), []byte("disk"), 0644), ShouldBeNil)
+			golds = append(golds, gold)
+		}
+
+		config := &providerConfig{cloneSlots: make(chan struct{}, 4)}
+		errs := make(chan error, 4)
+		for i := 0; i < cap(errs); i++ {
+			gold := golds[i%len(golds)]
+			vm := &vbox.Machine{BaseFolder: filepath.Join(home, "machine", fmt.Sprintf("node-%02d", i))}
+			So(os.MkdirAll(vm.BaseFolder, 0755), ShouldBeNil)
+			go func() {
+				_, err := cloneGoldDisks(config, vm, gold, []string{filepath.Join(gold, "box-disk001.vmdk")})
+				errs <- err
+			}()
+		}
+		for i := 0; i < cap(errs); i++ {
+			So(<-errs, ShouldBeNil)
+		}
+
+		// Each clone opened a copy of its own, never the gold disk
+		copies := make(map[string]bool)
+		for _, call := range fake.calls(t) {
+			So(call, ShouldNotContainSubstring, filepath.Join(home, "gold"))
+			if strings.Contains(call, "sethduuid") {
+				copies[call] = true
+			}
+		}
+		So(copies, ShouldHaveLength, cap(errs))
+		for _, gold := range golds {
+			data, err := ioutil.ReadFile(filepath.Join(gold, "box-disk001.vmdk"))
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "disk")
+		}
+		left, err := filepath.Glob(filepath.Join(home, "machine", "*", "gold-*"))
+		So(err, ShouldBeNil)
+		So(left, ShouldBeEmpty)
+	})
+}
+
+func TestResourceVM_drift(t *testing.T) {
+	fake := newFakeVBoxManage(t)
+	image, baseFolder := setupTestImage(t)
+	fake.script(t, fakeVMLifecycle(baseFolder, natVMInfo, natVMGuestInfo)...)
+
+	resource.UnitTest(t, resource.TestCase{
+		Providers:    testProviders(),
+		CheckDestroy: testCheckFakeDeleted(t, fake),
+		Steps: []resource.TestStep{
+			{
+				Config: testVMConfig(image, ""),
+			},
+			{
+				// The VM is resized and powered off outside of Terraform
+				PreConfig: func() {
+					info := append(natVMInfo, "cpus=1")
+					fake.script(t, fakeVMLifecycle(baseFolder, info, natVMGuestInfo)...)
+					if _, err := vboxManage("controlvm", "node-01", "poweroff"); err != nil {
+						t.Fatal(err)
+					}
+				},
+				Config:             testVMConfig(image, ""),
+				PlanOnly:           true,
+				ExpectNonEmptyPlan: true,
+			},
+		},
+	})
+}
+
+// fakeVMResize scripts the lifecycle of a VM whose modifyvm switches it to
+// a variant with 4 CPUs, which falls back to the original one until then.
+func fakeVMResize(baseFolder string) []fakeCommand {
+	resized := fakeVMLifecycle(baseFolder, append(natVMInfo, "cpus=4"), natVMGuestInfo)
+	for i := range resized {
+		if resized[i].State != "" {
+			resized[i].State += "-resized"
+		}
+		if resized[i].SetState != "" {
+			resized[i].SetState += "-resized"
+		}
+	}
+	commands := append([]fakeCommand{
+		{Args: []string{"modifyvm"}, SetState: "poweroff-resized"},
+	}, resized[:len(resized)-1]...)
+	return append(commands, fakeVMLifecycle(baseFolder, natVMInfo, natVMGuestInfo)...)
+}
+
+func TestResourceVM_updateRestart(t *testing.T) {
+	fake := newFakeVBoxManage(t)
+	image, baseFolder := setupTestImage(t)
+	fake.script(t, fakeVMLifecycle(baseFolder, natVMInfo, natVMGuestInfo)...)
+
+	resource.UnitTest(t, resource.TestCase{
+		Providers:    testProviders(),
+		CheckDestroy: testCheckFakeDeleted(t, fake),
+		Steps: []resource.TestStep{
+			{
+				Config: testVMConfig(image, ""),
+			},
+			{
+				// modifyvm switches the VM to its resized variant, which
+				// falls back to the original one until then
+				PreConfig: func() {
+					fake.script(t, fakeVMResize(baseFolder)...)
+				},
+				Config: testVMConfig(image, "cpus = 4"),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("virtualbox_vm.node", "cpus", "4"),
+					resource.TestCheckResourceAttr("virtualbox_vm.node", "status", "running"),
+					testCheckFakeCalled(t, fake, "controlvm node-01 poweroff", "--cpus 4", "startvm node-01"),
+				),
+			},
+		},
+	})
+}
+
+func TestResourceVM_updateKeepsUserData(t *testing.T) {
+	fake := newFakeVBoxManage(t)
+	image, baseFolder := setupTestImage(t)
+	userData := fakeCommand{Args: []string{"getextradata", "*", "user_data"}, Stdout: "Value: #cloud-config\n"}
+	fake.script(t, append([]fakeCommand{userData}, fakeVMLifecycle(baseFolder, natVMInfo, natVMGuestInfo)...)...)
+
+	// The state only holds a digest of the user data, which must never
+	// replace it
+	checkUserDataSetOnce := func(*terraform.State) error {
+		var set []string
+		for _, call := range fake.calls(t) {
+			if strings.HasPrefix(call, "setextradata node-01 user_data") {
+				set = append(set, call)
+			}
+		}
+		if len(set) != 1 || set[0] != "setextradata node-01 user_data #cloud-config" {
+			return fmt.Errorf("user data was set by:\n%s", strings.Join(set, "\n"))
+		}
+		return nil
+	}
+	checkSeedUserData := func(*terraform.State) error {
+		seed, err := ioutil.ReadFile(filepath.Join(baseFolder, cloudInitSeedFile))
+		if err != nil {
+			return err
+		}
+		files := readISORoot(seed, isoSectorSVD, decodeUCS2)
+		if files["user-data"] != "#cloud-config" {
+			return fmt.Errorf("seed has user-data %q", files["user-data"])
+		}
+		return nil
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		Providers:    testProviders(),
+		CheckDestroy: testCheckFakeDeleted(t, fake),
+		Steps: []resource.TestStep{
+			{
+				Config: testVMConfig(image, `user_data = "#cloud-config"`),
+				Check:  resource.ComposeTestCheckFunc(checkUserDataSetOnce, checkSeedUserData),
+			},
+			{
+				PreConfig: func() {
+					fake.script(t, append([]fakeCommand{userData}, fakeVMResize(baseFolder)...)...)
+				},
+				Config: testVMConfig(image, `user_data = "#cloud-config"
+  cpus      = 4`),
+				Check: resource.ComposeTestCheckFunc(
+					testCheckFakeCalled(t, fake, "--cpus 4"),
+					checkUserDataSetOnce,
+				),
+			},
+			{
+				// The seed is written again with the user data of the VM
+				Config: testVMConfig(image, `user_data = "#cloud-config"
+  cpus      = 4
+  meta_data = "instance-id: node-01-v2"`),
+				Check: resource.ComposeTestCheckFunc(checkUserDataSetOnce, checkSeedUserData),
+			},
+		},
+	})
+}
+
+func TestResourceVM_networkAdapters(t *testing.T) {
+	fake := newFakeVBoxManage(t)
+	image, baseFolder := setupTestImage(t)
+	// The guest enumerates the adapters in another order than VirtualBox
+	info := []string{
+		`nic1="nat"`, `nictype1="82545EM"`, `macaddress1="080027000001"`,
+		`nic2="hostonly"`, `nictype2="82540EM"`, `macaddress2="080027000002"`, `hostonlyadapter2="vboxnet0"`,
+	}
+	guestInfo := map[string]string{
+		"/VirtualBox/GuestInfo/Net/Count":    "2",
+		"/VirtualBox/GuestInfo/Net/0/MAC":    "080027000002",
+		"/VirtualBox/GuestInfo/Net/0/Status": "Up",
+		"/VirtualBox/GuestInfo/Net/0/V4/IP":  "192.168.56.10",
+		"/VirtualBox/GuestInfo/Net/1/MAC":    "080027000001",
+		"/VirtualBox/GuestInfo/Net/1/Status": "Down",
+		"/VirtualBox/GuestInfo/Net/1/V4/IP":  "10.0.2.15",
+	}
+	fake.script(t, fakeVMLifecycle(baseFolder, info, guestInfo)...)
+
+	resource.UnitTest(t, resource.TestCase{
+		Providers:    testProviders(),
+		CheckDestroy: testCheckFakeDeleted(t, fake),
+		Steps: []resource.TestStep{
+			{
+				Config: testVMConfig(image, `
+  network_adapter {
+    type           = "hostonly"
+    device         = "IntelPro1000MTDesktop"
+    host_interface = "vboxnet0"
+  }`),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("virtualbox_vm.node", "network_adapter.#", "2"),
+					resource.TestCheckResourceAttr("virtualbox_vm.node", "network_adapter.0.type", "nat"),
+					resource.TestCheckResourceAttr("virtualbox_vm.node", "network_adapter.0.ipv4_address", "10.0.2.15"),
+					resource.TestCheckResourceAttr("virtualbox_vm.node", "network_adapter.0.status", "down"),
+					resource.TestCheckResourceAttr("virtualbox_vm.node", "network_adapter.1.type", "hostonly"),
+					resource.TestCheckResourceAttr("virtualbox_vm.node", "network_adapter.1.host_interface", "vboxnet0"),
+					resource.TestCheckResourceAttr("virtualbox_vm.node", "network_adapter.1.mac_address", "080027000002"),
+					resource.TestCheckResourceAttr("virtualbox_vm.node", "network_adapter.1.ipv4_address", "192.168.56.10"),
+					testCheckFakeCalled(t, fake, "--nic2 hostonly", "--hostonlyadapter2 vboxnet0"),
+				),
+			},
+			{
+				// Removing all the adapters removes them from the VM, which the
+				// fake keeps reporting
+				Config: fmt.Sprintf(`
+resource "virtualbox_vm" "node" {
+  name  = "node-01"
+  image = %q
+}
+`, image),
+				Check:              testCheckFakeCalled(t, fake, "modifyvm "+testVMUUID+" --nic1 none --nic2 none --nic3 none --nic4 none"),
+				ExpectNonEmptyPlan: true,
+			},
+		},
+	})
+}
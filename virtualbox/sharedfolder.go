@@ -0,0 +1,200 @@
+package virtualbox
+
+import (
+	"bufio"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	vbox "github.com/terra-farm/go-virtualbox"
+)
+
+// sharedFolder is a host folder shared with the guest.
+type sharedFolder struct {
+	Name       string
+	HostPath   string
+	AutoMount  bool
+	ReadOnly   bool
+	MountPoint string
+	// Transient folders only live as long as the VM runs, they are added
+	// once the VM is started and can be changed without restarting it.
+	Transient bool
+}
+
+// Matches the shared folders listed by 'showvminfo', e.g.
+// Name: 'src', Host path: '/home/me/src' (machine mapping), writable, auto-mount, mount-point: '/src'
+var reSharedFolderLine = regexp.MustCompile(`^Name: '(.*)', Host path: '(.*)' \((machine|transient) mapping\)(.*)$`)
+
+// parseSharedFolders extracts the shared folders from the human readable
+// 'showvminfo' output, as the machine readable one lacks their options.
+func parseSharedFolders(out string) ([]sharedFolder, error) {
+	var folders []sharedFolder
+	s := bufio.NewScanner(strings.NewReader(out))
+	for s.Scan() {
+		res := reSharedFolderLine.FindStringSubmatch(strings.TrimSpace(s.Text()))
+		if res == nil {
+			continue
+		}
+		folder := sharedFolder{
+			Name:      res[1],
+			HostPath:  res[2],
+			Transient: res[3] == "transient",
+		}
+		for _, opt := range strings.Split(res[4], ", ") {
+			switch {
+			case opt == "readonly":
+				folder.ReadOnly = true
+			case opt == "auto-mount":
+				folder.AutoMount = true
+			case strings.HasPrefix(opt, "mount-point: "):
+				folder.MountPoint = strings.Trim(strings.TrimPrefix(opt, "mount-point: "), "'")
+			}
+		}
+		folders = append(folders, folder)
+	}
+	return folders, s.Err()
+}
+
+// readSharedFolders returns the shared folders of the VM.
+func readSharedFolders(vm *vbox.Machine) ([]sharedFolder, error) {
+	out, err := vboxManage("showvminfo", vm.UUID)
+	if err != nil {
+		return nil, err
+	}
+	return parseSharedFolders(out)
+}
+
+func addSharedFolder(vm *vbox.Machine, f sharedFolder) error {
+	args := []string{"sharedfolder", "add", vm.UUID, "--name", f.Name, "--hostpath", f.HostPath}
+	if f.ReadOnly {
+		args = append(args, "--readonly")
+	}
+	if f.AutoMount {
+		args = append(args, "--automount")
+	}
+	if f.MountPoint != "" {
+		args = append(args, "--auto-mount-point", f.MountPoint)
+	}
+	if f.Transient {
+		args = append(args, "--transient")
+	}
+	_, err := vboxManage(args...)
+	return errors.Wrapf(err, "can't add shared folder %q", f.Name)
+}
+
+func removeSharedFolder(vm *vbox.Machine, f sharedFolder) error {
+	args := []string{"sharedfolder", "remove", vm.UUID, "--name", f.Name}
+	if f.Transient {
+		args = append(args, "--transient")
+	}
+	_, err := vboxManage(args...)
+	return errors.Wrapf(err, "can't remove shared folder %q", f.Name)
+}
+
+// filterSharedFolders returns the folders which are, or are not, transient.
+func filterSharedFolders(folders []sharedFolder, transient bool) []sharedFolder {
+	var out []sharedFolder
+	for _, f := range folders {
+		if f.Transient == transient {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// sharedFoldersEqual tells whether both lists hold the same folders,
+// regardless of their order.
+func sharedFoldersEqual(a, b []sharedFolder) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	byName := make(map[string]sharedFolder, len(a))
+	for _, f := range a {
+		byName[f.Name] = f
+	}
+	for _, f := range b {
+		if byName[f.Name] != f {
+			return false
+		}
+	}
+	return true
+}
+
+// applySharedFolders updates the shared folders of the VM from one list to
+// the other. A folder whose options changed is removed and added again.
+func applySharedFolders(vm *vbox.Machine, from, to []sharedFolder) error {
+	wanted := make(map[string]sharedFolder, len(to))
+	for _, f := range to {
+		wanted[f.Name] = f
+	}
+	current := make(map[string]sharedFolder, len(from))
+	for _, f := range from {
+		if w, ok := wanted[f.Name]; ok && w == f {
+			current[f.Name] = f
+			continue
+		}
+		if err := removeSharedFolder(vm, f); err != nil {
+			return err
+		}
+	}
+	for _, f := range to {
+		if _, ok := current[f.Name]; ok {
+			continue
+		}
+		if err := addSharedFolder(vm, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sharedFoldersTfToVbox converts the "shared_folder" blocks.
+func sharedFoldersTfToVbox(blocks []interface{}) []sharedFolder {
+	folders := make([]sharedFolder, 0, len(blocks))
+	for _, block := range blocks {
+		m := block.(map[string]interface{})
+		folders = append(folders, sharedFolder{
+			Name:       m["name"].(string),
+			HostPath:   m["host_path"].(string),
+			AutoMount:  m["auto_mount"].(bool),
+			ReadOnly:   m["read_only"].(bool),
+			MountPoint: m["mount_point"].(string),
+			Transient:  m["transient"].(bool),
+		})
+	}
+	return folders
+}
+
+// sharedFoldersVboxToTf converts the shared folders of the VM to
+// "shared_folder" blocks, keeping the order of the configured ones.
+func sharedFoldersVboxToTf(folders []sharedFolder, configured []sharedFolder) []map[string]interface{} {
+	byName := make(map[string]sharedFolder, len(folders))
+	for _, f := range folders {
+		byName[f.Name] = f
+	}
+	ordered := make([]sharedFolder, 0, len(folders))
+	for _, f := range configured {
+		if found, ok := byName[f.Name]; ok {
+			ordered = append(ordered, found)
+			delete(byName, f.Name)
+		}
+	}
+	for _, f := range folders {
+		if _, ok := byName[f.Name]; ok {
+			ordered = append(ordered, f)
+		}
+	}
+
+	blocks := make([]map[string]interface{}, 0, len(ordered))
+	for _, f := range ordered {
+		blocks = append(blocks, map[string]interface{}{
+			"name":        f.Name,
+			"host_path":   f.HostPath,
+			"auto_mount":  f.AutoMount,
+			"read_only":   f.ReadOnly,
+			"mount_point": f.MountPoint,
+			"transient":   f.Transient,
+		})
+	}
+	return blocks
+}
@@ -0,0 +1,41 @@
+package virtualbox
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// Excerpt of 'VBoxManage showvminfo' from VirtualBox 6.1
+const showVMInfoSharedFolders = `Name:                        node-01
+Groups:                      /
+Guest OS:                    Ubuntu (64-bit)
+
+Shared folders:
+
+Name: 'src', Host path: '/home/me/src' (machine mapping), writable, auto-mount, mount-point: '/src'
+Name: 'docs', Host path: '/home/me/My Docs' (machine mapping), readonly
+Name: 'tmp', Host path: '/tmp' (transient mapping), writable
+
+VRDE Connection:             not active
+`
+
+func TestParseSharedFolders(t *testing.T) {
+	Convey("Parse shared folders from showvminfo", t, func() {
+		folders, err := parseSharedFolders(showVMInfoSharedFolders)
+		So(err, ShouldBeNil)
+		So(folders, ShouldResemble, []sharedFolder{
+			{Name: "src", HostPath: "/home/me/src", AutoMount: true, MountPoint: "/src"},
+			{Name: "docs", HostPath: "/home/me/My Docs", ReadOnly: true},
+			{Name: "tmp", HostPath: "/tmp", Transient: true},
+		})
+
+		Convey("And keep the configured order when converting them back", func() {
+			blocks := sharedFoldersVboxToTf(folders, []sharedFolder{{Name: "tmp"}, {Name: "src"}})
+			So(blocks, ShouldHaveLength, 3)
+			So(blocks[0]["name"], ShouldEqual, "tmp")
+			So(blocks[1]["name"], ShouldEqual, "src")
+			So(blocks[2]["name"], ShouldEqual, "docs")
+		})
+	})
+}
@@ -0,0 +1,253 @@
+package virtualbox
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/openpgp"
+)
+
+// signatureExts are the extensions of detached signatures. Without them,
+// the signature URL is the URL of the signed file.
+var signatureExts = []string{".asc", ".gpg", ".sig", ".minisig"}
+
+// signedURL returns the URL of the file signed by the signature at
+// signatureURL.
+func signedURL(signatureURL string) (string, error) {
+	for _, ext := range signatureExts {
+		if strings.HasSuffix(signatureURL, ext) {
+			return strings.TrimSuffix(signatureURL, ext), nil
+		}
+	}
+	return "", fmt.Errorf("signature %s doesn't end with one of %s", signatureURL, strings.Join(signatureExts, ", "))
+}
+
+// verifySignature checks the image at file against its signature. The
+// signature is either of the image itself, or of a checksum file listing
+// it, like SHA256SUMS.gpg.
+func (img *image) verifySignature(config *providerConfig, file string) error {
+	signature, err := fetchImage(config, &image{URL: img.SignatureURL})
+	if err != nil {
+		return errors.Wrap(err, "can't fetch signature")
+	}
+	signed, err := signedURL(img.SignatureURL)
+	if err != nil {
+		return err
+	}
+	// The image and its signature may be in different places, like a local
+	// image signed on its download site
+	name, err := urlBase(img.URL)
+	if err != nil {
+		return err
+	}
+	signedName, err := urlBase(signed)
+	if err != nil {
+		return err
+	}
+	if signedName == name {
+		log.Printf("[DEBUG] Verifying image signature %s...", img.SignatureURL)
+		return verifyDetachedSignature(img.PublicKey, file, signature, false)
+	}
+
+	sums, err := fetchImage(config, &image{URL: signed})
+	if err != nil {
+		return errors.Wrap(err, "can't fetch checksum file")
+	}
+	log.Printf("[DEBUG] Verifying checksum file signature %s...", img.SignatureURL)
+	if err := verifyDetachedSignature(img.PublicKey, sums, signature, true); err != nil {
+		return err
+	}
+	checksum, err := lookupChecksum(sums, name)
+	if err != nil {
+		return err
+	}
+	return checksum.verify(file)
+}
+
+// urlBase returns the file name of the URL or path.
+func urlBase(addr string) (string, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", err
+	}
+	return path.Base(filepath.ToSlash(u.Path)), nil
+}
+
+// lookupChecksum returns the checksum of the file name listed in the
+// checksum file at path, in the format of sha256sum, "<hex>  name", or of
+// BSD, "SHA256 (name) = <hex>".
+func lookupChecksum(path, name string) (*image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	checksumTypes := map[int]string{32: "md5", 40: "sha1", 64: "sha256", 128: "sha512"}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var sum, file string
+		fields := strings.Fields(scanner.Text())
+		switch {
+		case len(fields) == 2:
+			sum, file = fields[0], strings.TrimPrefix(fields[1], "*")
+		case len(fields) == 4 && fields[2] == "=":
+			sum, file = fields[3], strings.TrimSuffix(strings.TrimPrefix(fields[1], "("), ")")
+		default:
+			continue
+		}
+		if file != name && strings.TrimPrefix(file, "./") != name {
+			continue
+		}
+		checksumType, ok := checksumTypes[len(sum)]
+		if !ok {
+			return nil, fmt.Errorf("unknown checksum %s of %s", sum, name)
+		}
+		return &image{Checksum: sum, ChecksumType: checksumType}, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("%s is not listed in the checksum file", name)
+}
+
+// verifyDetachedSignature checks the signature at signaturePath of the file
+// at path with the public key, an armored OpenPGP key or a minisign key.
+// Legacy minisign signatures are only accepted for small files, like
+// checksum files.
+func verifyDetachedSignature(publicKey, path, signaturePath string, small bool) error {
+	signature, err := ioutil.ReadFile(signaturePath)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if strings.Contains(publicKey, "-----BEGIN PGP PUBLIC KEY BLOCK-----") {
+		return verifyOpenPGP(publicKey, f, signature)
+	}
+	return verifyMinisign(publicKey, f, signature, small)
+}
+
+// verifyOpenPGP checks the OpenPGP signature, armored or not, of the file.
+func verifyOpenPGP(publicKey string, f io.Reader, signature []byte) error {
+	keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(publicKey))
+	if err != nil {
+		return errors.Wrap(err, "can't read OpenPGP public key")
+	}
+	check := openpgp.CheckDetachedSignature
+	if bytes.HasPrefix(bytes.TrimSpace(signature), []byte("-----BEGIN PGP SIGNATURE-----")) {
+		check = openpgp.CheckArmoredDetachedSignature
+	}
+	signer, err := check(keyring, f, bytes.NewReader(signature))
+	if err != nil {
+		return errors.Wrap(err, "bad OpenPGP signature")
+	}
+	for _, identity := range signer.Identities {
+		log.Printf("[DEBUG] Good OpenPGP signature from %s", identity.Name)
+	}
+	return nil
+}
+
+// minisign keys and signatures are base64 lines, after an untrusted
+// comment line, of the algorithm, the key ID and the key or signature.
+const (
+	minisignAlgorithm       = "Ed"
+	minisignHashedAlgorithm = "ED"
+	minisignKeyIDSize       = 8
+
+	// maxLegacyMinisignSize bounds the files read whole to check their
+	// legacy, not prehashed, minisign signature.
+	maxLegacyMinisignSize = 1 << 20
+)
+
+// minisignLines returns the lines of the minisign key or signature, without
+// the untrusted comment.
+func minisignLines(data string) []string {
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "untrusted comment:") {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// verifyMinisign checks the minisign signature of the file, along with its
+// trusted comment. Legacy signatures sign the whole file rather than its
+// hash, they are only accepted for small files, up to maxLegacyMinisignSize.
+func verifyMinisign(publicKey string, f io.Reader, signature []byte, small bool) error {
+	lines := minisignLines(publicKey)
+	if len(lines) != 1 {
+		return errors.New("public key is neither an armored OpenPGP key nor a minisign key")
+	}
+	key, err := base64.StdEncoding.DecodeString(lines[0])
+	if err != nil || len(key) != 2+minisignKeyIDSize+ed25519.PublicKeySize || string(key[:2]) != minisignAlgorithm {
+		return errors.New("can't read minisign public key")
+	}
+	keyID, pub := key[2:2+minisignKeyIDSize], ed25519.PublicKey(key[2+minisignKeyIDSize:])
+
+	lines = minisignLines(string(signature))
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "trusted comment: ") {
+		return errors.New("can't read minisign signature")
+	}
+	sig, err := base64.StdEncoding.DecodeString(lines[0])
+	if err != nil || len(sig) != 2+minisignKeyIDSize+ed25519.SignatureSize {
+		return errors.New("can't read minisign signature")
+	}
+	globalSig, err := base64.StdEncoding.DecodeString(lines[2])
+	if err != nil || len(globalSig) != ed25519.SignatureSize {
+		return errors.New("can't read minisign trusted comment signature")
+	}
+	if !bytes.Equal(sig[2:2+minisignKeyIDSize], keyID) {
+		return errors.New("minisign signature was made with another key")
+	}
+
+	var message []byte
+	switch string(sig[:2]) {
+	case minisignAlgorithm:
+		if !small {
+			return errors.New("legacy minisign signatures are only accepted for checksum files, sign images prehashed")
+		}
+		if message, err = ioutil.ReadAll(io.LimitReader(f, maxLegacyMinisignSize+1)); err != nil {
+			return err
+		}
+		if len(message) > maxLegacyMinisignSize {
+			return fmt.Errorf("file is too large for a legacy minisign signature, over %d bytes", maxLegacyMinisignSize)
+		}
+	case minisignHashedAlgorithm:
+		hash, _ := blake2b.New512(nil)
+		if _, err := io.Copy(hash, f); err != nil {
+			return err
+		}
+		message = hash.Sum(nil)
+	default:
+		return fmt.Errorf("unknown minisign signature algorithm %q", sig[:2])
+	}
+	if !ed25519.Verify(pub, message, sig[2+minisignKeyIDSize:]) {
+		return errors.New("bad minisign signature")
+	}
+	comment := strings.TrimPrefix(lines[1], "trusted comment: ")
+	if !ed25519.Verify(pub, append(sig[2+minisignKeyIDSize:], comment...), globalSig) {
+		return errors.New("bad minisign trusted comment signature")
+	}
+	log.Printf("[DEBUG] Good minisign signature, trusted comment: %s", comment)
+	return nil
+}
@@ -0,0 +1,207 @@
+package virtualbox
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// newOpenPGPKey returns a new OpenPGP signing key and its armored public key.
+func newOpenPGPKey(t *testing.T) (*openpgp.Entity, string) {
+	entity, err := openpgp.NewEntity("Images", "", "images@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	return entity, buf.String()
+}
+
+// minisignKey is a minisign key pair.
+type minisignKey struct {
+	id      []byte
+	private ed25519.PrivateKey
+	public  string
+}
+
+func newMinisignKey(t *testing.T) *minisignKey {
+	pub, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, minisignKeyIDSize)
+	rand.Read(id)
+	public := append(append([]byte(minisignAlgorithm), id...), pub...)
+	return &minisignKey{id: id, private: private,
+		public: "untrusted comment: minisign public key\n" + base64.StdEncoding.EncodeToString(public) + "\n"}
+}
+
+// sign returns the minisign signature of data, prehashed or not.
+func (k *minisignKey) sign(data []byte, prehashed bool) string {
+	algorithm, message := minisignAlgorithm, data
+	if prehashed {
+		hash := blake2b.Sum512(data)
+		algorithm, message = minisignHashedAlgorithm, hash[:]
+	}
+	sig := append(append([]byte(algorithm), k.id...), ed25519.Sign(k.private, message)...)
+	comment := "timestamp:1600000000\tfile:ubuntu.img"
+	global := ed25519.Sign(k.private, append(sig[2+minisignKeyIDSize:], comment...))
+	return fmt.Sprintf("untrusted comment: signature from minisign secret key\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(sig), comment, base64.StdEncoding.EncodeToString(global))
+}
+
+func TestVerifySignature(t *testing.T) {
+	Convey("Verify images against an OpenPGP signed checksum file", t, func() {
+		entity, publicKey := newOpenPGPKey(t)
+		content := "box"
+		sums := fmt.Sprintf("%x  ubuntu.img\n%x *other.img\n", sha256.Sum256([]byte(content)), sha256.Sum256(nil))
+		var signature bytes.Buffer
+		So(openpgp.DetachSign(&signature, entity, strings.NewReader(sums), nil), ShouldBeNil)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/ubuntu.img":
+				w.Write([]byte(content))
+			case "/SHA256SUMS":
+				w.Write([]byte(sums))
+			case "/SHA256SUMS.gpg":
+				w.Write(signature.Bytes())
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+		defer server.Close()
+		config := &providerConfig{CacheDir: tempDir(t)}
+		img := &image{URL: server.URL + "/ubuntu.img", SignatureURL: server.URL + "/SHA256SUMS.gpg", PublicKey: publicKey}
+
+		_, err := fetchIfRemote(config, img)
+		So(err, ShouldBeNil)
+
+		content = "tampered box"
+		_, err = fetchIfRemote(config, img)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "checksum does not match")
+
+		content = "box"
+		_, img.PublicKey = newOpenPGPKey(t)
+		_, err = fetchIfRemote(config, img)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "bad OpenPGP signature")
+	})
+
+	Convey("Verify local images against their minisign signature", t, func() {
+		key := newMinisignKey(t)
+		dir := tempDir(t)
+		path := filepath.Join(dir, "ubuntu.img")
+		So(ioutil.WriteFile(path, []byte("box"), 0644), ShouldBeNil)
+		img := &image{URL: path, SignatureURL: path + ".minisig", PublicKey: key.public}
+
+		// Legacy signatures would need the whole image in memory
+		So(ioutil.WriteFile(img.SignatureURL, []byte(key.sign([]byte("box"), false)), 0644), ShouldBeNil)
+		_, err := fetchIfRemote(nil, img)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "legacy minisign signatures are only accepted for checksum files")
+
+		So(ioutil.WriteFile(img.SignatureURL, []byte(key.sign([]byte("box"), true)), 0644), ShouldBeNil)
+		_, err = fetchIfRemote(nil, img)
+		So(err, ShouldBeNil)
+
+		So(ioutil.WriteFile(path, []byte("tampered box"), 0644), ShouldBeNil)
+		_, err = fetchIfRemote(nil, img)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "bad minisign signature")
+
+		img.PublicKey = newMinisignKey(t).public
+		_, err = fetchIfRemote(nil, img)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "another key")
+	})
+
+	Convey("Verify local images against a checksum file with a legacy minisign signature", t, func() {
+		key := newMinisignKey(t)
+		dir := tempDir(t)
+		path := filepath.Join(dir, "ubuntu.img")
+		So(ioutil.WriteFile(path, []byte("box"), 0644), ShouldBeNil)
+		sums := fmt.Sprintf("%x  ubuntu.img\n", sha256.Sum256([]byte("box")))
+		So(ioutil.WriteFile(filepath.Join(dir, "SHA256SUMS"), []byte(sums), 0644), ShouldBeNil)
+		img := &image{URL: path, SignatureURL: filepath.Join(dir, "SHA256SUMS.minisig"), PublicKey: key.public}
+
+		So(ioutil.WriteFile(img.SignatureURL, []byte(key.sign([]byte(sums), false)), 0644), ShouldBeNil)
+		_, err := fetchIfRemote(nil, img)
+		So(err, ShouldBeNil)
+
+		// Unless the checksum file is too large to be read whole
+		large := sums + strings.Repeat("#\n", maxLegacyMinisignSize)
+		So(ioutil.WriteFile(filepath.Join(dir, "SHA256SUMS"), []byte(large), 0644), ShouldBeNil)
+		So(ioutil.WriteFile(img.SignatureURL, []byte(key.sign([]byte(large), false)), 0644), ShouldBeNil)
+		_, err = fetchIfRemote(nil, img)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "too large")
+	})
+
+	Convey("Verify local images against their signature on the download site", t, func() {
+		key := newMinisignKey(t)
+		signature := key.sign([]byte("box"), true)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/releases/ubuntu.img.minisig" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte(signature))
+		}))
+		defer server.Close()
+		path := filepath.Join(tempDir(t), "ubuntu.img")
+		So(ioutil.WriteFile(path, []byte("box"), 0644), ShouldBeNil)
+		img := &image{URL: path, SignatureURL: server.URL + "/releases/ubuntu.img.minisig", PublicKey: key.public}
+		config := &providerConfig{CacheDir: tempDir(t)}
+
+		_, err := fetchIfRemote(config, img)
+		So(err, ShouldBeNil)
+
+		img.URL = "file://" + filepath.ToSlash(path)
+		_, err = fetchIfRemote(config, img)
+		So(err, ShouldBeNil)
+
+		So(ioutil.WriteFile(path, []byte("tampered box"), 0644), ShouldBeNil)
+		_, err = fetchIfRemote(config, img)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "bad minisign signature")
+	})
+
+	Convey("Reject signatures of unknown files", t, func() {
+		_, err := signedURL("https://images.example.com/ubuntu.img.signature")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Look checksums up in BSD format", t, func() {
+		path := filepath.Join(tempDir(t), "CHECKSUM")
+		sum := fmt.Sprintf("%x", sha256.Sum256([]byte("box")))
+		So(ioutil.WriteFile(path, []byte("# Fedora\nSHA256 (ubuntu.img) = "+sum+"\n"), 0644), ShouldBeNil)
+		checksum, err := lookupChecksum(path, "ubuntu.img")
+		So(err, ShouldBeNil)
+		So(checksum, ShouldResemble, &image{Checksum: sum, ChecksumType: "sha256"})
+
+		_, err = lookupChecksum(path, "other.img")
+		So(err, ShouldNotBeNil)
+	})
+}
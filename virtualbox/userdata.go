@@ -0,0 +1,130 @@
+package virtualbox
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+	"github.com/pkg/errors"
+	vbox "github.com/terra-farm/go-virtualbox"
+)
+
+const (
+	// Payloads larger than this are gzipped before being stored as extradata.
+	userDataGzipThreshold = 4 * 1024
+	// Extradata values are handed to VBoxManage on its command line, which
+	// windows limits to 32767 characters.
+	maxExtraDataSize = 32000
+	// Prefix marking an extradata value as gzipped and base64 encoded.
+	extraDataGzipPrefix = "gzip+base64:"
+)
+
+// hashUserData is the StateFunc of the user data attributes, so that only
+// a digest of the payload ends up in the state and in plans.
+func hashUserData(v interface{}) string {
+	s, ok := v.(string)
+	if !ok || s == "" {
+		return ""
+	}
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// userDataPayload returns the user data set in either "user_data" or
+// "user_data_base64", nil if none is set. Only digests of the user data are
+// kept in the state, so the payload comes from the configuration when the
+// attributes change, as on create, and from the VM extradata otherwise.
+func userDataPayload(d *schema.ResourceData, vm *vbox.Machine) ([]byte, error) {
+	if !d.HasChanges("user_data", "user_data_base64") {
+		if d.Get("user_data").(string) == "" && d.Get("user_data_base64").(string) == "" {
+			return nil, nil
+		}
+		value, err := vm.GetExtraData("user_data")
+		if err != nil || value == nil {
+			return nil, errors.Wrap(err, "can't get user data")
+		}
+		return decodeExtraData(*value)
+	}
+
+	if v := d.Get("user_data").(string); v != "" {
+		return []byte(v), nil
+	}
+	if v := d.Get("user_data_base64").(string); v != "" {
+		payload, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't decode user_data_base64")
+		}
+		return payload, nil
+	}
+	return nil, nil
+}
+
+// encodeExtraData encodes a payload into an extradata value. Small text
+// payloads are kept verbatim, anything else is gzipped and base64 encoded.
+func encodeExtraData(payload []byte) (string, error) {
+	if len(payload) <= userDataGzipThreshold && utf8.Valid(payload) &&
+		bytes.IndexByte(payload, 0) < 0 && !bytes.HasPrefix(payload, []byte(extraDataGzipPrefix)) {
+		return string(payload), nil
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(payload); err != nil {
+		return "", errors.Wrap(err, "can't gzip payload")
+	}
+	if err := zw.Close(); err != nil {
+		return "", errors.Wrap(err, "can't gzip payload")
+	}
+	return extraDataGzipPrefix + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// decodeExtraData reverses encodeExtraData.
+func decodeExtraData(value string) ([]byte, error) {
+	if !strings.HasPrefix(value, extraDataGzipPrefix) {
+		return []byte(value), nil
+	}
+	compressed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, extraDataGzipPrefix))
+	if err != nil {
+		return nil, errors.Wrap(err, "can't decode extradata")
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, errors.Wrap(err, "can't gunzip extradata")
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
+
+// validateUserData rejects payloads that do not fit in VirtualBox extradata.
+func validateUserData(i interface{}, k string) ([]string, []error) {
+	v, ok := i.(string)
+	if !ok {
+		return nil, []error{fmt.Errorf("expected type of %s to be string", k)}
+	}
+
+	payload := []byte(v)
+	if k == "user_data_base64" {
+		var err error
+		if payload, err = base64.StdEncoding.DecodeString(v); err != nil {
+			return nil, []error{fmt.Errorf("%s is not valid base64: %v", k, err)}
+		}
+	}
+
+	encoded, err := encodeExtraData(payload)
+	if err != nil {
+		return nil, []error{fmt.Errorf("%s: %v", k, err)}
+	}
+	if len(encoded) > maxExtraDataSize {
+		return nil, []error{fmt.Errorf(
+			"%s is %d bytes once encoded for VirtualBox extradata, the limit is %d bytes",
+			k, len(encoded), maxExtraDataSize)}
+	}
+	return nil, nil
+}
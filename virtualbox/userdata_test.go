@@ -0,0 +1,58 @@
+package virtualbox
+
+import (
+	"encoding/base64"
+	"math/rand"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestExtraDataEncoding(t *testing.T) {
+	Convey("Encode user data for VirtualBox extradata", t, func() {
+		Convey("Small text payloads should be stored verbatim", func() {
+			value, err := encodeExtraData([]byte("#cloud-config\n"))
+			So(err, ShouldBeNil)
+			So(value, ShouldEqual, "#cloud-config\n")
+		})
+
+		Convey("Large payloads should be gzipped and survive a round trip", func() {
+			payload := []byte(strings.Repeat("packages: [vim]\n", 1000))
+			value, err := encodeExtraData(payload)
+			So(err, ShouldBeNil)
+			So(value, ShouldStartWith, extraDataGzipPrefix)
+			So(len(value), ShouldBeLessThan, len(payload))
+
+			decoded, err := decodeExtraData(value)
+			So(err, ShouldBeNil)
+			So(string(decoded), ShouldEqual, string(payload))
+		})
+
+		Convey("Binary payloads should be encoded and survive a round trip", func() {
+			payload := []byte{0x1f, 0x8b, 0, 0xff}
+			value, err := encodeExtraData(payload)
+			So(err, ShouldBeNil)
+			So(value, ShouldStartWith, extraDataGzipPrefix)
+
+			decoded, err := decodeExtraData(value)
+			So(err, ShouldBeNil)
+			So(decoded, ShouldResemble, payload)
+		})
+	})
+
+	Convey("Validate user data at plan time", t, func() {
+		_, errs := validateUserData("#cloud-config\n", "user_data")
+		So(errs, ShouldBeEmpty)
+
+		_, errs = validateUserData("not base64!", "user_data_base64")
+		So(errs, ShouldHaveLength, 1)
+
+		// Random data does not compress, so it can't fit once encoded
+		random := make([]byte, maxExtraDataSize)
+		rand.New(rand.NewSource(1)).Read(random)
+		_, errs = validateUserData(base64.StdEncoding.EncodeToString(random), "user_data_base64")
+		So(errs, ShouldHaveLength, 1)
+		So(errs[0].Error(), ShouldContainSubstring, "the limit is")
+	})
+}
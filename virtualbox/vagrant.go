@@ -0,0 +1,330 @@
+package virtualbox
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	vbox "github.com/terra-farm/go-virtualbox"
+)
+
+// Files of a Vagrant box, next to its disks.
+const (
+	boxMetadataFile   = "metadata.json"
+	boxOVFFile        = "box.ovf"
+	boxVagrantfile    = "Vagrantfile"
+	vagrantProviderVB = "virtualbox"
+)
+
+// vagrantBox is the hardware a Vagrant box was built for.
+type vagrantBox struct {
+	// VirtualBox OS type ID, like "Ubuntu_64"
+	OSType string
+	// Firmware for 'modifyvm --firmware', like "efi"
+	Firmware string
+	// Disks in the order of box.ovf, with their slots
+	Disks []boxDisk
+	// MAC address of the first NAT adapter, without colons
+	BaseMAC string
+}
+
+// boxDisk is the slot of a disk of a Vagrant box.
+type boxDisk struct {
+	File   string
+	Bus    vbox.SystemBus
+	Port   int
+	Device int
+}
+
+// ovfEnvelope is the part of box.ovf describing the hardware. Elements and
+// attributes are matched by local name, whatever their namespace.
+type ovfEnvelope struct {
+	Files []struct {
+		ID   string `xml:"id,attr"`
+		Href string `xml:"href,attr"`
+	} `xml:"References>File"`
+	Disks []struct {
+		ID      string `xml:"diskId,attr"`
+		FileRef string `xml:"fileRef,attr"`
+	} `xml:"DiskSection>Disk"`
+	System struct {
+		OSType string    `xml:"OperatingSystemSection>OSType"`
+		Items  []ovfItem `xml:"VirtualHardwareSection>Item"`
+		// VirtualBox specific section
+		Machine struct {
+			OSType   string `xml:"OSType,attr"`
+			Firmware struct {
+				Type string `xml:"type,attr"`
+			} `xml:"Hardware>Firmware"`
+		} `xml:"Machine"`
+	} `xml:"VirtualSystem"`
+}
+
+// ovfItem is a virtual hardware item of box.ovf.
+type ovfItem struct {
+	InstanceID      string `xml:"InstanceID"`
+	ResourceType    int    `xml:"ResourceType"`
+	Address         string `xml:"Address"`
+	AddressOnParent string `xml:"AddressOnParent"`
+	Parent          string `xml:"Parent"`
+	HostResource    string `xml:"HostResource"`
+}
+
+// OVF resource types of the items.
+const (
+	ovfResourceIDE  = 5
+	ovfResourceSCSI = 6
+	ovfResourceDisk = 17
+	ovfResourceSATA = 20
+)
+
+// modifyVMFirmware converts a firmware type of box.ovf or showvminfo to
+// 'modifyvm --firmware', empty for the BIOS that vm.Modify sets.
+func modifyVMFirmware(firmware string) string {
+	switch firmware = strings.ToLower(firmware); firmware {
+	case "", "bios":
+		return ""
+	case "efidual":
+		return "efi"
+	default:
+		return firmware
+	}
+}
+
+// parseBoxOVF parses the OS type, firmware and disk layout of box.ovf.
+func parseBoxOVF(data []byte, box *vagrantBox) error {
+	var env ovfEnvelope
+	if err := xml.Unmarshal(data, &env); err != nil {
+		return err
+	}
+
+	box.OSType = env.System.Machine.OSType
+	if box.OSType == "" {
+		box.OSType = strings.TrimSpace(env.System.OSType)
+	}
+	box.Firmware = modifyVMFirmware(env.System.Machine.Firmware.Type)
+
+	files := make(map[string]string)
+	for _, f := range env.Files {
+		files[f.ID] = f.Href
+	}
+	disks := make(map[string]string)
+	for _, d := range env.Disks {
+		disks[d.ID] = files[d.FileRef]
+	}
+	controllers := make(map[string]ovfItem)
+	for _, item := range env.System.Items {
+		switch item.ResourceType {
+		case ovfResourceIDE, ovfResourceSCSI, ovfResourceSATA:
+			controllers[item.InstanceID] = item
+		}
+	}
+
+	for _, item := range env.System.Items {
+		if item.ResourceType != ovfResourceDisk {
+			continue
+		}
+		ctl, ok := controllers[item.Parent]
+		if !ok {
+			return fmt.Errorf("disk %s has no controller", item.InstanceID)
+		}
+		file := disks[path.Base(item.HostResource)]
+		if file == "" {
+			return fmt.Errorf("disk %s has no file", item.InstanceID)
+		}
+		addr, err := strconv.Atoi(item.AddressOnParent)
+		if err != nil {
+			return errors.Wrapf(err, "can't parse address of disk %s", item.InstanceID)
+		}
+		disk := boxDisk{File: file, Port: addr}
+		switch ctl.ResourceType {
+		case ovfResourceIDE:
+			// Each IDE channel is a controller item, with master and slave
+			channel, _ := strconv.Atoi(ctl.Address)
+			disk.Bus, disk.Port, disk.Device = vbox.SysBusIDE, channel, addr
+		case ovfResourceSCSI:
+			disk.Bus = vbox.SysBusSCSI
+		default:
+			disk.Bus = vbox.SysBusSATA
+		}
+		box.Disks = append(box.Disks, disk)
+	}
+	return nil
+}
+
+var reBaseMAC = regexp.MustCompile(`base_mac\s*=\s*["']([0-9A-Fa-f:]{12,17})["']`)
+
+// readVagrantBox reads the Vagrant box unpacked into the gold folder, nil if
+// the image isn't a Vagrant box.
+func readVagrantBox(goldPath string) (*vagrantBox, error) {
+	var box *vagrantBox
+	read := func(name string) ([]byte, error) {
+		data, err := ioutil.ReadFile(filepath.Join(goldPath, name))
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		if err == nil && box == nil {
+			box = &vagrantBox{}
+		}
+		return data, err
+	}
+
+	metadata, err := read(boxMetadataFile)
+	if err != nil {
+		return nil, err
+	}
+	if metadata != nil {
+		var m struct {
+			Provider string `json:"provider"`
+		}
+		if err := json.Unmarshal(metadata, &m); err != nil {
+			return nil, errors.Wrapf(err, "can't parse %s", boxMetadataFile)
+		}
+		if m.Provider != "" && m.Provider != vagrantProviderVB {
+			return nil, fmt.Errorf("the box is for the %s provider, not %s", m.Provider, vagrantProviderVB)
+		}
+	}
+
+	ovf, err := read(boxOVFFile)
+	if err != nil {
+		return nil, err
+	}
+	if ovf != nil {
+		if err := parseBoxOVF(ovf, box); err != nil {
+			return nil, errors.Wrapf(err, "can't parse %s", boxOVFFile)
+		}
+	}
+
+	vagrantfile, err := read(boxVagrantfile)
+	if err != nil {
+		return nil, err
+	}
+	if res := reBaseMAC.FindSubmatch(vagrantfile); res != nil {
+		box.BaseMAC = strings.ToUpper(strings.Replace(string(res[1]), ":", "", -1))
+	}
+	return box, nil
+}
+
+// layoutDisks returns the slots of the VM disks, following the layout of
+// the box. Disks missing from it, or all of them without a box, go to the
+// SATA controller in order. The boot disk, if any, lands on the first SATA
+// port, trading slots with the disk there.
+func layoutDisks(box *vagrantBox, disks []string, bootDisk string) []boxDisk {
+	slots := make([]boxDisk, 0, len(disks))
+	placed := make(map[string]bool)
+	sataPorts := 0
+	if box != nil {
+		byName := make(map[string]string)
+		for _, disk := range disks {
+			byName[filepath.Base(disk)] = disk
+		}
+		for _, slot := range box.Disks {
+			disk, ok := byName[filepath.Base(slot.File)]
+			if !ok || placed[disk] {
+				continue
+			}
+			slot.File = disk
+			slots = append(slots, slot)
+			placed[disk] = true
+			if slot.Bus == vbox.SysBusSATA && slot.Port >= sataPorts {
+				sataPorts = slot.Port + 1
+			}
+		}
+	}
+	for _, disk := range disks {
+		if placed[disk] {
+			continue
+		}
+		slots = append(slots, boxDisk{File: disk, Bus: vbox.SysBusSATA, Port: sataPorts})
+		sataPorts++
+	}
+
+	boot, first := -1, -1
+	for i, slot := range slots {
+		if slot.File == bootDisk {
+			boot = i
+		}
+		if slot.Bus == vbox.SysBusSATA && slot.Port == 0 && slot.Device == 0 {
+			first = i
+		}
+	}
+	switch {
+	case bootDisk == "" || boot < 0 || boot == first:
+	case first >= 0:
+		slots[boot].File, slots[first].File = slots[first].File, slots[boot].File
+	default:
+		slots[boot] = boxDisk{File: bootDisk, Bus: vbox.SysBusSATA}
+	}
+	return slots
+}
+
+// applyBoxHardware sets the firmware and base MAC address of the box on the
+// VM, once vm.Modify reset them.
+func applyBoxHardware(vm *vbox.Machine, box *vagrantBox) error {
+	if box == nil {
+		return nil
+	}
+	var args []string
+	if box.Firmware != "" {
+		args = append(args, "--firmware", box.Firmware)
+	}
+	if box.BaseMAC != "" {
+		for i, nic := range vm.NICs {
+			if nic.Network == vbox.NICNetNAT {
+				args = append(args, fmt.Sprintf("--macaddress%d", i+1), box.BaseMAC)
+				break
+			}
+		}
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	if _, err := vboxManage(append([]string{"modifyvm", vm.UUID}, args...)...); err != nil {
+		return err
+	}
+	return errors.Wrap(vm.Refresh(), "can't refresh VM")
+}
+
+// keptHardware returns the OS type and firmware of the VM, which vm.Modify
+// resets, so that updates keep those of the Vagrant box.
+func keptHardware(vm *vbox.Machine) (*vagrantBox, error) {
+	out, err := vboxManage("showvminfo", vm.UUID, "--machinereadable")
+	if err != nil {
+		return nil, err
+	}
+	props, err := parseMachineReadable(out)
+	if err != nil {
+		return nil, err
+	}
+
+	kept := &vagrantBox{Firmware: modifyVMFirmware(props["firmware"])}
+
+	// showvminfo lists the OS type by its description
+	osType := props["ostype"]
+	if osType == "" {
+		return kept, nil
+	}
+	out, err = vboxManage("list", "ostypes")
+	if err != nil {
+		return nil, err
+	}
+	osTypes, err := parseOSTypes(out)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range osTypes {
+		if t["description"] == osType || t["id"] == osType {
+			kept.OSType = t["id"].(string)
+			break
+		}
+	}
+	return kept, nil
+}
@@ -0,0 +1,149 @@
+package virtualbox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/resource"
+	. "github.com/smartystreets/goconvey/convey"
+	vbox "github.com/terra-farm/go-virtualbox"
+)
+
+func TestVagrantBox(t *testing.T) {
+	Convey("Read the hardware of a Vagrant box", t, func() {
+		box, err := readVagrantBox(filepath.Join("testdata", "vagrant"))
+		So(err, ShouldBeNil)
+		So(box, ShouldResemble, &vagrantBox{
+			OSType:   "Ubuntu_64",
+			Firmware: "efi",
+			Disks: []boxDisk{
+				{File: "box-disk001.vmdk", Bus: vbox.SysBusSATA, Port: 0, Device: 0},
+				{File: "box-disk002.vmdk", Bus: vbox.SysBusIDE, Port: 1, Device: 1},
+			},
+			BaseMAC: "0800271A2B3C",
+		})
+	})
+
+	Convey("Ignore images that aren't Vagrant boxes", t, func() {
+		box, err := readVagrantBox("testdata")
+		So(err, ShouldBeNil)
+		So(box, ShouldBeNil)
+	})
+
+	Convey("Reject boxes of other providers", t, func() {
+		dir, err := ioutil.TempDir("", "tfvbox-box-")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		So(ioutil.WriteFile(filepath.Join(dir, boxMetadataFile), []byte(`{"provider": "libvirt"}`), 0644), ShouldBeNil)
+
+		_, err = readVagrantBox(dir)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "libvirt")
+	})
+
+	Convey("Lay out the disks after the box", t, func() {
+		box := &vagrantBox{Disks: []boxDisk{
+			{File: "box-disk002.vmdk", Bus: vbox.SysBusIDE, Port: 0, Device: 1},
+			{File: "box-disk001.vmdk", Bus: vbox.SysBusSATA, Port: 2},
+		}}
+		disks := []string{"/vm/box-disk001.vmdk", "/vm/box-disk002.vmdk", "/vm/extra.vdi"}
+		So(layoutDisks(box, disks, ""), ShouldResemble, []boxDisk{
+			{File: "/vm/box-disk002.vmdk", Bus: vbox.SysBusIDE, Port: 0, Device: 1},
+			{File: "/vm/box-disk001.vmdk", Bus: vbox.SysBusSATA, Port: 2},
+			{File: "/vm/extra.vdi", Bus: vbox.SysBusSATA, Port: 3},
+		})
+		So(layoutDisks(nil, disks[:2], ""), ShouldResemble, []boxDisk{
+			{File: "/vm/box-disk001.vmdk", Bus: vbox.SysBusSATA, Port: 0},
+			{File: "/vm/box-disk002.vmdk", Bus: vbox.SysBusSATA, Port: 1},
+		})
+	})
+
+	Convey("Put the boot disk on the first SATA port", t, func() {
+		disks := []string{"/vm/box-disk001.vmdk", "/vm/box-disk002.vmdk", "/vm/extra.vdi"}
+		So(layoutDisks(nil, disks, "/vm/extra.vdi"), ShouldResemble, []boxDisk{
+			{File: "/vm/extra.vdi", Bus: vbox.SysBusSATA, Port: 0},
+			{File: "/vm/box-disk002.vmdk", Bus: vbox.SysBusSATA, Port: 1},
+			{File: "/vm/box-disk001.vmdk", Bus: vbox.SysBusSATA, Port: 2},
+		})
+
+		box := &vagrantBox{Disks: []boxDisk{
+			{File: "box-disk001.vmdk", Bus: vbox.SysBusIDE, Port: 0},
+			{File: "box-disk002.vmdk", Bus: vbox.SysBusIDE, Port: 1},
+		}}
+		So(layoutDisks(box, disks[:2], "/vm/box-disk002.vmdk"), ShouldResemble, []boxDisk{
+			{File: "/vm/box-disk001.vmdk", Bus: vbox.SysBusIDE, Port: 0},
+			{File: "/vm/box-disk002.vmdk", Bus: vbox.SysBusSATA},
+		})
+	})
+
+	Convey("Keep the OS type and firmware of the VM", t, func() {
+		fake := newFakeVBoxManage(t)
+		fake.script(t,
+			fakeCommand{Args: []string{"showvminfo"},
+				Stdout: fakeVMInfo("node-01", "/vm", "poweroff", `ostype="Ubuntu (64-bit)"`, `firmware="EFI"`)},
+			fakeCommand{Args: []string{"list", "ostypes"}, Stdout: readVBoxManageOutput("list_ostypes.txt")},
+		)
+		kept, err := keptHardware(&vbox.Machine{UUID: testVMUUID})
+		So(err, ShouldBeNil)
+		So(kept, ShouldResemble, &vagrantBox{OSType: "Ubuntu_64", Firmware: "efi"})
+	})
+}
+
+func TestResourceVM_vagrantBox(t *testing.T) {
+	fake := newFakeVBoxManage(t)
+	image, baseFolder := setupTestImage(t,
+		filepath.Join("testdata", "vagrant", "box.ovf"),
+		filepath.Join("testdata", "vagrant", "metadata.json"),
+		filepath.Join("testdata", "vagrant", "Vagrantfile"),
+		filepath.Join("testdata", "vagrant", "box-disk002.vmdk"))
+	goldFolder := filepath.Join(filepath.Dir(filepath.Dir(baseFolder)), "gold", "ubuntu")
+	disk2 := filepath.Join(baseFolder, "box-disk002.vmdk")
+	fake.script(t, append([]fakeCommand{
+		{Args: []string{"clonehd", filepath.Join(goldFolder, "box-disk002.vmdk")}, Create: []string{disk2}},
+	}, fakeVMLifecycle(baseFolder, natVMInfo, natVMGuestInfo)...)...)
+
+	resource.UnitTest(t, resource.TestCase{
+		Providers:    testProviders(),
+		CheckDestroy: testCheckFakeDeleted(t, fake),
+		Steps: []resource.TestStep{
+			{
+				Config: testVMConfig(image, ""),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("virtualbox_vm.node", "id", testVMUUID),
+					testCheckFakeCalled(t, fake,
+						"--ostype Ubuntu_64",
+						"modifyvm "+testVMUUID+" --firmware efi --macaddress1 0800271A2B3C",
+						"storagectl node-01 --name IDE --add ide",
+						"storageattach node-01 --storagectl IDE --port 1 --device 1 --type hdd --medium "+disk2,
+						"storageattach node-01 --storagectl SATA --port 0 --device 0"),
+				),
+			},
+		},
+	})
+}
+
+func TestResourceVM_bootDisk(t *testing.T) {
+	fake := newFakeVBoxManage(t)
+	image, baseFolder := setupTestImage(t, filepath.Join("testdata", "vagrant", "box-disk002.vmdk"))
+	disk1 := filepath.Join(baseFolder, "box-disk001.vmdk")
+	disk2 := filepath.Join(baseFolder, "box-disk002.vmdk")
+	fake.script(t, fakeVMLifecycle(baseFolder, natVMInfo, natVMGuestInfo)...)
+
+	resource.UnitTest(t, resource.TestCase{
+		Providers:    testProviders(),
+		CheckDestroy: testCheckFakeDeleted(t, fake),
+		Steps: []resource.TestStep{
+			{
+				Config: testVMConfig(image, `boot_disk = "box-disk002.vmdk"`),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("virtualbox_vm.node", "boot_disk", "box-disk002.vmdk"),
+					testCheckFakeCalled(t, fake,
+						"storageattach node-01 --storagectl SATA --port 0 --device 0 --type hdd --medium "+disk2,
+						"storageattach node-01 --storagectl SATA --port 1 --device 0 --type hdd --medium "+disk1),
+				),
+			},
+		},
+	})
+}
@@ -0,0 +1,70 @@
+package virtualbox
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+)
+
+var (
+	// Values accepted in the virtualbox_vm configuration.
+	// Read writes any of the statuses back, so they all validate
+	validVMStatuses     = []string{"poweroff", "running", "paused", "saved", "aborted"}
+	validBootDevices    = []string{"none", "floppy", "dvd", "disk", "net"}
+	validNetworkTypes   = []string{"nat", "bridged", "hostonly", "internal", "generic"}
+	validNetworkDevices = []string{
+		"PCIII", "FASTIII", "IntelPro1000MTDesktop", "IntelPro1000TServer", "IntelPro1000MTServer",
+	}
+	// An empty checksum type, like an unset one, goes with an empty checksum
+	validChecksumTypes   = []string{"", "md5", "sha1", "sha256", "sha512"}
+	validHardwareSources = []string{hardwareTerraform, hardwareAppliance}
+	validImageFormats    = []string{
+		imageFormatBox, imageFormatOVA, imageFormatOVF, imageFormatVDI, imageFormatVMDK,
+		diskFormatRaw, diskFormatVHD, diskFormatQcow2,
+	}
+)
+
+// maxNetworkAdapters is the number of NICs go-virtualbox reads back from
+// the VM.
+const maxNetworkAdapters = 4
+
+// customizeDiffNetworkAdapters checks that host-only and bridged adapters
+// are bound to a host interface.
+func customizeDiffNetworkAdapters(d *schema.ResourceDiff, meta interface{}) error {
+	for i, adapter := range d.Get("network_adapter").([]interface{}) {
+		nic, ok := adapter.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		switch nic["type"] {
+		case "hostonly", "bridged":
+		default:
+			continue
+		}
+		key := fmt.Sprintf("network_adapter.%d.host_interface", i)
+		if !d.NewValueKnown(key) {
+			continue
+		}
+		if nic["host_interface"] == "" {
+			return fmt.Errorf("%s: required for %s network adapters", key, nic["type"])
+		}
+	}
+	return nil
+}
+
+// customizeDiffChecksum checks that a checksum comes with its algorithm.
+func customizeDiffChecksum(d *schema.ResourceDiff, meta interface{}) error {
+	if d.Get("checksum").(string) != "" && d.Get("checksum_type").(string) == "" {
+		return fmt.Errorf("checksum_type: required when checksum is set")
+	}
+	return nil
+}
+
+// customizeDiffSignature checks that a signature comes with the key trusted
+// to sign it.
+func customizeDiffSignature(d *schema.ResourceDiff, meta interface{}) error {
+	if d.Get("signature_url").(string) != "" && d.Get("public_key").(string) == "" {
+		return fmt.Errorf("public_key: required when signature_url is set")
+	}
+	return nil
+}
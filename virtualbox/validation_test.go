@@ -0,0 +1,107 @@
+package virtualbox
+
+import (
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/terraform"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// planVM validates and diffs a virtualbox_vm configuration the way
+// 'terraform plan' does, returning the first error.
+func planVM(raw map[string]interface{}) error {
+	r := resourceVM()
+	c := terraform.NewResourceConfigRaw(raw)
+	if _, errs := r.Validate(c); len(errs) > 0 {
+		return errs[0]
+	}
+	_, err := r.Diff(nil, c, nil)
+	return err
+}
+
+func TestVMPlanValidation(t *testing.T) {
+	base := func() map[string]interface{} {
+		return map[string]interface{}{"name": "node-01", "image": "ubuntu.box"}
+	}
+
+	Convey("Plan a valid VM", t, func() {
+		raw := base()
+		raw["memory"] = "1 GiB"
+		raw["boot_order"] = []interface{}{"disk", "dvd"}
+		raw["network_adapter"] = []interface{}{
+			map[string]interface{}{"type": "nat"},
+			map[string]interface{}{"type": "hostonly", "host_interface": "vboxnet0"},
+		}
+		So(planVM(raw), ShouldBeNil)
+	})
+
+	Convey("Accept every status Read writes back and an empty checksum type", t, func() {
+		for _, status := range validVMStatuses {
+			raw := base()
+			raw["status"] = status
+			raw["checksum_type"] = ""
+			So(planVM(raw), ShouldBeNil)
+		}
+	})
+
+	Convey("Reject invalid values at plan time", t, func() {
+		for key, value := range map[string]interface{}{
+			"status":        "stopped",
+			"memory":        "lots",
+			"checksum_type": "crc32",
+			"boot_order":    []interface{}{"floopy"},
+			"network_adapter": []interface{}{
+				map[string]interface{}{"type": "nat", "device": "e1000"},
+			},
+		} {
+			raw := base()
+			raw[key] = value
+			So(planVM(raw), ShouldNotBeNil)
+		}
+	})
+
+	Convey("Reject host-only adapters without host interface", t, func() {
+		raw := base()
+		raw["network_adapter"] = []interface{}{map[string]interface{}{"type": "hostonly"}}
+		err := planVM(raw)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "network_adapter.0.host_interface")
+	})
+
+	Convey("Reject more network adapters than supported", t, func() {
+		raw := base()
+		var nics []interface{}
+		for i := 0; i <= maxNetworkAdapters; i++ {
+			nics = append(nics, map[string]interface{}{"type": "nat"})
+		}
+		raw["network_adapter"] = nics
+		So(planVM(raw), ShouldNotBeNil)
+	})
+
+	Convey("Reject a checksum without its type", t, func() {
+		raw := base()
+		raw["checksum"] = "d41d8cd98f00b204e9800998ecf8427e"
+		So(planVM(raw), ShouldNotBeNil)
+	})
+
+	Convey("Reject a signature without its public key", t, func() {
+		raw := base()
+		raw["signature_url"] = "https://cloud-images.ubuntu.com/bionic/current/SHA256SUMS.gpg"
+		So(planVM(raw), ShouldNotBeNil)
+	})
+
+	Convey("Replace the VM when the signature of its image changes", t, func() {
+		state := &terraform.InstanceState{ID: "0b3a5bd2-2d0e-4d5a-a3b5-6f5e2d1c1f11", Attributes: map[string]string{
+			"name": "node-01", "image": "ubuntu.box", "status": "running", "cpus": "2",
+			"signature_url": "SHA256SUMS.gpg", "public_key": "old key",
+		}}
+		for key, value := range map[string]string{"signature_url": "SHA512SUMS.gpg", "public_key": "new key"} {
+			raw := base()
+			raw["signature_url"], raw["public_key"] = "SHA256SUMS.gpg", "old key"
+			raw[key] = value
+			diff, err := resourceVM().Diff(state, terraform.NewResourceConfigRaw(raw), nil)
+			So(err, ShouldBeNil)
+			So(diff.RequiresNew(), ShouldBeTrue)
+		}
+	})
+}
@@ -0,0 +1,35 @@
+package virtualbox
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// vboxManagePath returns the path of the VBoxManage utility, honouring
+// VBOX_INSTALL_PATH on windows.
+func vboxManagePath() string {
+	if p := os.Getenv("VBOX_INSTALL_PATH"); p != "" && runtime.GOOS == "windows" {
+		return filepath.Join(p, "VBoxManage.exe")
+	}
+	return "VBoxManage"
+}
+
+// vboxManage runs VBoxManage for commands not covered by go-virtualbox and
+// returns its standard output.
+func vboxManage(args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(vboxManagePath(), args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return stdout.String(), errors.Wrapf(err, "VBoxManage %s: %s",
+			strings.Join(args, " "), strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}